@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// BatchRule sets defaults for batch cataloged sources whose path matches
+// Match. Track fields select a stream index (a negative index drops the
+// track), Tags are added to the full-length region, and TrimStart/TrimEnd are
+// cut from its start and end. Every matching rule is applied in order.
+type BatchRule struct {
+	Match     string
+	Video     *int     `json:",omitempty"`
+	Audio     *int     `json:",omitempty"`
+	Subtitle  *int     `json:",omitempty"`
+	Tags      []string `json:",omitempty"`
+	TrimStart Duration
+	TrimEnd   Duration
+}
+
+// Matches reports whether path matches the rule's glob; globs without a
+// separator are matched against the base name.
+func (r BatchRule) Matches(path string) (bool, error) {
+	if !strings.ContainsRune(r.Match, filepath.Separator) {
+		path = filepath.Base(path)
+	}
+	return filepath.Match(r.Match, path)
+}
+
+// selectTrack replaces *t by the stream index of media, keeping what ffprobe
+// found out about it, and makes the other probed streams its alternatives.
+// Dropping the track drops its alternatives too, so that language selection
+// does not bring one back.
+func (r BatchRule) selectTrack(t **Track, alternatives *[]Track, media string, index *int) {
+	if index == nil {
+		return
+	}
+
+	var probed []Track
+	if alternatives != nil {
+		probed = append(probed, *alternatives...)
+	}
+	if *t != nil {
+		probed = append(probed, **t)
+	}
+
+	var chosen *Track
+	var rest []Track
+	for i := range probed {
+		if chosen == nil && *index >= 0 && probed[i].Path == Input(media) && probed[i].Track == uint(*index) {
+			chosen = &probed[i]
+		} else {
+			rest = append(rest, probed[i])
+		}
+	}
+	if *index < 0 {
+		rest = nil
+	} else if chosen == nil {
+		// a stream ffprobe did not report
+		chosen = &Track{Path: Input(media), Track: uint(*index)}
+	}
+
+	*t = chosen
+	if alternatives != nil {
+		*alternatives = rest
+	}
+}
+
+func (r BatchRule) apply(s *Source, media string) (err error) {
+	r.selectTrack(&s.Video, nil, media, r.Video)
+	r.selectTrack(&s.Audio, &s.AudioAlternatives, media, r.Audio)
+	r.selectTrack(&s.Subtitle, &s.SubtitleAlternatives, media, r.Subtitle)
+
+	if len(s.Regions) == 0 {
+		return
+	}
+	full := &s.Regions[0]
+	full.Tags = append(full.Tags, r.Tags...)
+	full.Start = full.Start.Add(r.TrimStart)
+	full.End.Duration -= r.TrimEnd.Duration
+	if err = full.Valid(); err != nil {
+		return fmt.Errorf("mashu.BatchRule.apply: rule '%s' trims away all of '%s': %w", r.Match, s.Key, err)
+	}
+
+	return
+}
+
+func loadBatchRules(path string) (rules []BatchRule, err error) {
+	if path == "" {
+		return
+	}
+
+	if err = decodeJsonFromFile(path, &rules); err != nil {
+		err = fmt.Errorf("mashu.loadBatchRules: unable to load rules ('%s'): %w", path, err)
+		return
+	}
+
+	for _, r := range rules {
+		if _, err = filepath.Match(r.Match, ""); err != nil {
+			err = fmt.Errorf("mashu.loadBatchRules: bad glob '%s': %w", r.Match, err)
+			return
+		}
+	}
+
+	return
+}
+
+func batchSource(o CatalogOptions, path string) (s Source, err error) {
+	s.Key = path
+	s.Unreviewed = true
+
+	media := path
+	var m3u []string
+	if m3u, err = getM3uEntries(path); err == nil {
+		if len(m3u) == 0 {
+			err = fmt.Errorf("mashu.batchSource: empty m3u")
+			return
+		}
+		media = m3u[0]
+	} else if !errors.Is(err, ErrNoM3UHeader) {
+		return
+	}
+
+	if err = addTracksFromVideo(media, &s, o.ChapterRules); err != nil {
+		return
+	}
+	end := s.Regions[0].End
+
+	for _, r := range o.BatchRules {
+		var match bool
+		if match, err = r.Matches(path); err != nil {
+			return
+		}
+		if !match {
+			continue
+		}
+		if err = r.apply(&s, media); err != nil {
+			return
+		}
+	}
+
+	if o.Propose {
+		if err = proposeRegions(context.TODO(), &s, end, o.Detect); err != nil {
+			log.Printf("mashu.batchSource: no region proposals for %s: %v", path, err)
+			err = nil
+		}
+	}
+
+	if err = s.Valid(); err != nil {
+		return
+	}
+
+	err = s.Fingerprint()
+	return
+}
+
+// batchSources builds sources without opening an editor; they are marked
+// Unreviewed so that they can be revisited with -catalog -review.
+func batchSources(o CatalogOptions, paths ...string) (sources []Source) {
+	for _, path := range paths {
+		s, err := batchSource(o, path)
+		if err != nil {
+			log.Printf("mashu.batchSources: skipping %s: %v", path, err)
+			continue
+		}
+		sources = append(sources, s)
+	}
+
+	return
+}
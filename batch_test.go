@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchRuleTracks(t *testing.T) {
+	probed := func() Source {
+		a := []Track{
+			{Path: "ep.mkv", Track: 0, Language: "ja"},
+			{Path: "ep.mkv", Track: 1, Language: "en", Title: "Commentary"},
+			{Path: "ep.mkv", Track: 2, Language: "en"},
+		}
+		return Source{Audio: &a[2], AudioAlternatives: a[:2], Subtitle: &Track{Path: "ep.mkv", Language: "en"}}
+	}
+	index := func(i int) *int { return &i }
+
+	s := probed()
+	if err := (BatchRule{Audio: index(0)}).apply(&s, "ep.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if want := (Track{Path: "ep.mkv", Track: 0, Language: "ja"}); s.Audio == nil || *s.Audio != want {
+		t.Errorf("audio = %v, want %v", s.Audio, want)
+	}
+	want := []Track{{Path: "ep.mkv", Track: 1, Language: "en", Title: "Commentary"}, {Path: "ep.mkv", Track: 2, Language: "en"}}
+	if !reflect.DeepEqual(s.AudioAlternatives, want) {
+		t.Errorf("audio alternatives = %v, want %v", s.AudioAlternatives, want)
+	}
+
+	s = probed()
+	if err := (BatchRule{Audio: index(-1), Subtitle: index(3)}).apply(&s, "ep.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Audio != nil || len(s.AudioAlternatives) != 0 {
+		t.Errorf("dropped audio = %v, alternatives %v, want none", s.Audio, s.AudioAlternatives)
+	}
+	if want := (Track{Path: "ep.mkv", Track: 3}); s.Subtitle == nil || *s.Subtitle != want {
+		t.Errorf("subtitle = %v, want %v", s.Subtitle, want)
+	}
+	if want := []Track{{Path: "ep.mkv", Language: "en"}}; !reflect.DeepEqual(s.SubtitleAlternatives, want) {
+		t.Errorf("subtitle alternatives = %v, want %v", s.SubtitleAlternatives, want)
+	}
+}
@@ -49,36 +49,37 @@ func vim(path ...string) (err error) {
 	return cmd.Run()
 }
 
+type probeStream struct {
+	CodecType string `json:"codec_type"`
+	Tags      struct {
+		Language string `json:"language"`
+		Title    string `json:"title"`
+	} `json:"tags"`
+}
+
 type probeResult struct {
-	Streams []struct {
-		CodecType string `json:"codec_type"`
-	} `json:"streams"`
-	Format struct {
+	Streams  []probeStream  `json:"streams"`
+	Chapters []probeChapter `json:"chapters"`
+	Format   struct {
 		Duration string `json:"duration"`
 	} `json:"format"`
 }
 
-func (r probeResult) tracksOf(codecType string) (c uint) {
+// tracks returns a track for every stream of codecType in the file at path.
+func (r probeResult) tracks(path, codecType string) (tracks []Track) {
 	for _, t := range r.Streams {
 		if t.CodecType == codecType {
-			c++
+			tracks = append(tracks, Track{
+				Path:     Input(path),
+				Track:    uint(len(tracks)),
+				Language: t.Tags.Language,
+				Title:    t.Tags.Title,
+			})
 		}
 	}
 	return
 }
 
-func (r probeResult) VideoTracks() uint {
-	return r.tracksOf("video")
-}
-
-func (r probeResult) AudioTracks() uint {
-	return r.tracksOf("audio")
-}
-
-func (r probeResult) SubtitleTracks() uint {
-	return r.tracksOf("subtitle")
-}
-
 func (r probeResult) Duration() (d Duration, err error) {
 	err = (&d).UnmarshalJSON([]byte(fmt.Sprintf("\"%ss\"", r.Format.Duration)))
 	return
@@ -89,7 +90,8 @@ func ffprobe(path string) (r probeResult, err error) {
 	cmd := exec.CommandContext(context.TODO(),
 		"ffprobe",
 		"-v", "error",
-		"-show_entries", "stream=codec_type:format=duration",
+		"-show_entries", "stream=codec_type:stream_tags=language,title:format=duration",
+		"-show_chapters",
 		"-of", "json",
 		path)
 	cmd.Stdout = &buffer
@@ -102,7 +104,15 @@ func ffprobe(path string) (r probeResult, err error) {
 	return
 }
 
-func addTracksFromVideo(path string, s *Source) (err error) {
+// CatalogOptions configures how new sources are built.
+type CatalogOptions struct {
+	Propose      bool
+	Detect       DetectOptions
+	BatchRules   []BatchRule
+	ChapterRules []ChapterRule
+}
+
+func addTracksFromVideo(path string, s *Source, chapterRules []ChapterRule) (err error) {
 	var r probeResult
 	if r, err = ffprobe(path); err != nil {
 		return err
@@ -114,23 +124,31 @@ func addTracksFromVideo(path string, s *Source) (err error) {
 	}
 	s.Regions = append(s.Regions, TaggedRegion{Region: Region{End: d}})
 
-	v, a, t := r.VideoTracks(), r.AudioTracks(), r.SubtitleTracks()
-	if v > 0 {
-		s.Video = &Track{Path: Input(path), Track: v - 1}
+	var chapters []TaggedRegion
+	if chapters, err = chapterRegions(r.Chapters, chapterRules); err != nil {
+		return
+	}
+	s.Regions = append(s.Regions, chapters...)
+
+	// the last stream of each kind is the default; other audio and
+	// subtitle streams are kept as alternatives for language selection
+	if v := r.tracks(path, "video"); len(v) > 0 {
+		s.Video = &v[len(v)-1]
 	}
-	if a > 0 {
-		s.Audio = &Track{Path: Input(path), Track: a - 1}
+	if a := r.tracks(path, "audio"); len(a) > 0 {
+		s.Audio = &a[len(a)-1]
+		s.AudioAlternatives = a[:len(a)-1]
 	}
-	if t > 0 {
-		s.Subtitle = &Track{Path: Input(path), Track: t - 1}
+	if t := r.tracks(path, "subtitle"); len(t) > 0 {
+		s.Subtitle = &t[len(t)-1]
+		s.SubtitleAlternatives = t[:len(t)-1]
 	}
 
 	return
 }
 
-func buildSources(paths ...string) (sources []Source, err error) {
-	names := make([]string, 0)
-	mpvPaths := make([]string, 0)
+func buildSources(o CatalogOptions, paths ...string) (sources []Source, err error) {
+	drafts := make([]Source, 0)
 
 	for _, path := range paths {
 		var s Source
@@ -142,11 +160,17 @@ func buildSources(paths ...string) (sources []Source, err error) {
 				log.Printf("mashu.buildSources: skipping %s: empty m3u", path)
 				continue
 			}
-			if err = addTracksFromVideo(m3u[0], &s); err != nil {
+			if err = addTracksFromVideo(m3u[0], &s, o.ChapterRules); err != nil {
 				log.Printf("mashu.buildSources: skipping %s: %v", path, err)
 				err = nil
 				continue
 			}
+			if o.Propose {
+				if err = proposeRegions(context.TODO(), &s, s.Regions[0].End, o.Detect); err != nil {
+					log.Printf("mashu.buildSources: no region proposals for %s: %v", path, err)
+					err = nil
+				}
+			}
 		}
 		if errors.Is(err, ErrNoM3UHeader) {
 			err = nil
@@ -160,6 +184,19 @@ func buildSources(paths ...string) (sources []Source, err error) {
 			continue
 		}
 
+		drafts = append(drafts, s)
+	}
+
+	return editSources(drafts)
+}
+
+// editSources opens each draft in vim (alongside mpv playing its key) and
+// returns the validated and fingerprinted results.
+func editSources(drafts []Source) (sources []Source, err error) {
+	names := make([]string, 0)
+	mpvPaths := make([]string, 0)
+
+	for _, s := range drafts {
 		var f *os.File
 		if f, err = os.CreateTemp("", "mashu-build-source-*.json"); err != nil {
 			return
@@ -168,8 +205,8 @@ func buildSources(paths ...string) (sources []Source, err error) {
 		defer os.Remove(f.Name())
 
 		names = append(names, f.Name())
-		mpvPaths = append(mpvPaths, path)
-		fmt.Fprintln(f, path)
+		mpvPaths = append(mpvPaths, s.Key)
+		fmt.Fprintln(f, s.Key)
 		encoder := json.NewEncoder(f)
 		encoder.SetIndent("", "\t")
 		if err = encoder.Encode(s); err != nil {
@@ -192,14 +229,17 @@ func buildSources(paths ...string) (sources []Source, err error) {
 	for _, name := range names {
 		var s Source
 		if err = decodeJsonFromFile(name, &s); err != nil {
-			log.Printf("mashu.buildSources: unable to import %s: %v", name, err)
+			log.Printf("mashu.editSources: unable to import %s: %v", name, err)
 			continue
 		}
 		sources = append(sources, s)
 	}
 
-	for _, s := range sources {
-		if err = s.Valid(); err != nil {
+	for i := range sources {
+		if err = sources[i].Valid(); err != nil {
+			return
+		}
+		if err = sources[i].Fingerprint(); err != nil {
 			return
 		}
 	}
@@ -3,27 +3,80 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"fsmap"
+	"io/fs"
 	"math/rand"
 	"os"
-	"path/filepath"
+	"sort"
+	"syscall"
 )
 
-type Catalog struct {
-	path  string
-	fsmap *fsmap.Fsmap
+// Catalog stores sources by key. Lookup, Update and Delete of a missing key
+// return an error wrapping fs.ErrNotExist; Create of an existing key returns an
+// error wrapping fs.ErrExist. Keys are returned in catalog order.
+type Catalog interface {
+	Keys(ctx context.Context) ([]string, error)
+	Lookup(key string) (Source, error)
+	Create(s Source) error
+	Update(s Source) error
+	Delete(key string) error
 }
 
-func NewCatalog(path, algorithm string) (c *Catalog, err error) {
-	c = &Catalog{path: path}
-	c.fsmap, err = fsmap.New(path, algorithm)
-	return
+// batchCatalog is implemented by catalogs that apply many writes for little
+// more than the cost of one: the writes fn makes through b are made under a
+// single lock and the catalog's index is stored once, after fn returns.
+type batchCatalog interface {
+	Batch(fn func(b Catalog) error) error
+}
+
+// catalogBatch runs fn with a batch of c when c supports batches and with c
+// itself otherwise.
+func catalogBatch(c Catalog, fn func(b Catalog) error) error {
+	if bc, ok := c.(batchCatalog); ok {
+		return bc.Batch(fn)
+	}
+	return fn(c)
+}
+
+type catalogOpener func(path, algorithm string) (Catalog, error)
+
+var catalogBackends = map[string]catalogOpener{
+	"jsonl": func(path, algorithm string) (Catalog, error) {
+		return NewJsonlCatalog(path)
+	},
 }
 
-func (c Catalog) Keys(ctx context.Context) (keys []string, err error) {
+// NewCatalog opens the catalog at path using the named backend. An empty
+// backend selects fsmap when it is compiled in and jsonl otherwise.
+func NewCatalog(backend, path, algorithm string) (c Catalog, err error) {
+	if backend == "" {
+		backend = "jsonl"
+		if _, ok := catalogBackends["fsmap"]; ok {
+			backend = "fsmap"
+		}
+	}
+
+	open, ok := catalogBackends[backend]
+	if !ok {
+		names := make([]string, 0, len(catalogBackends))
+		for name := range catalogBackends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("mashu.NewCatalog: unknown catalog backend '%s' (available: %v)", backend, names)
+	}
+
+	return open(path, algorithm)
+}
+
+func shuffleKeys(r *rand.Rand, keys []string) {
+	r.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+}
+
+func readKeys(ctx context.Context, path string) (keys []string, err error) {
 	var f *os.File
-	if f, err = os.Open(filepath.Join(c.path, "keys")); err != nil {
+	if f, err = os.Open(path); err != nil {
 		return
 	}
 	defer f.Close()
@@ -32,7 +85,7 @@ func (c Catalog) Keys(ctx context.Context) (keys []string, err error) {
 	for d.More() {
 		var s string
 		if err = d.Decode(&s); err != nil {
-			err = fmt.Errorf("mashu.Catalog.Keys: error decoding keys: %w", err)
+			err = fmt.Errorf("mashu.readKeys: error decoding keys: %w", err)
 			return
 		}
 		select {
@@ -44,56 +97,69 @@ func (c Catalog) Keys(ctx context.Context) (keys []string, err error) {
 		}
 	}
 
-	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
 	return
 }
 
-func (c Catalog) Lookup(key string) (s Source, err error) {
-	var path string
-	if path, err = c.fsmap.Lookup([]byte(key), false); err != nil {
+func appendKey(path, key string) (err error) {
+	var k *os.File
+	if k, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
 		return
 	}
+	defer k.Close()
 
-	if err = decodeJsonFromFile(filepath.Join(path, "source.json"), &s); err != nil {
-		return
+	ke := json.NewEncoder(k)
+	if err = ke.Encode(key); err != nil {
+		return fmt.Errorf("mashu.appendKey: unable to encode key: %w", err)
 	}
 
-	return
+	return k.Close()
 }
 
-func (c Catalog) Create(s Source) (err error) {
-	var path string
-	if path, err = c.fsmap.Lookup([]byte(s.Key), true); err != nil {
+func removeKey(path, key string) (err error) {
+	var keys []string
+	if keys, err = readKeys(context.TODO(), path); err != nil && !os.IsNotExist(err) {
 		return
 	}
 
-	sourcePath := Output(filepath.Join(path, "source.json"))
-	if err = sourcePath.Valid(); err != nil {
-		return fmt.Errorf("mashu.Catalog.Create: for key '%s': %w", s.Key, err)
+	remaining := make([]any, 0, len(keys))
+	for _, k := range keys {
+		if k != key {
+			remaining = append(remaining, k)
+		}
 	}
 
+	return encodeJsonToFile(path, remaining...)
+}
+
+func errNoSource(key string) error {
+	return fmt.Errorf("mashu.Catalog: no source for key '%s': %w", key, fs.ErrNotExist)
+}
+
+func errSourceExists(key string) error {
+	return fmt.Errorf("mashu.Catalog: source for key '%s' already exists: %w", key, fs.ErrExist)
+}
+
+var ErrCatalogLocked = errors.New("catalog is locked by another process")
+
+// lockCatalog takes an exclusive advisory lock on the file at path, failing
+// with ErrCatalogLocked instead of waiting when another process holds it.
+func lockCatalog(path string) (unlock func(), err error) {
 	var f *os.File
-	if f, err = os.Create(string(sourcePath)); err != nil {
+	if f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644); err != nil {
 		return
 	}
-	defer f.Close()
 
-	e := json.NewEncoder(f)
-	if err = e.Encode(s); err != nil {
-		os.Remove(f.Name())
-		return fmt.Errorf("mashu.Catalog.Create: unable to encode source: %w", err)
-	}
-
-	var k *os.File
-	if k, err = os.OpenFile(filepath.Join(c.path, "keys"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			err = fmt.Errorf("mashu.lockCatalog: '%s': %w", path, ErrCatalogLocked)
+		}
 		return
 	}
-	defer k.Close()
 
-	ke := json.NewEncoder(k)
-	if err = ke.Encode(s.Key); err != nil {
-		return fmt.Errorf("mashu.Catalog.Create: unable to encode key: %w", err)
+	unlock = func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
 	}
-
 	return
 }
@@ -0,0 +1,209 @@
+//go:build fsmap
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"fsmap"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+func init() {
+	catalogBackends["fsmap"] = func(path, algorithm string) (Catalog, error) {
+		return NewFsmapCatalog(path, algorithm)
+	}
+}
+
+// FsmapCatalog stores each source as source.json in a directory allocated by
+// fsmap, with an append-only keys file listing every cataloged key and an
+// index file next to it. Writers hold an advisory lock on the lock file in
+// the catalog directory.
+type FsmapCatalog struct {
+	path  string
+	fsmap *fsmap.Fsmap
+}
+
+func NewFsmapCatalog(path, algorithm string) (c *FsmapCatalog, err error) {
+	c = &FsmapCatalog{path: path}
+	c.fsmap, err = fsmap.New(path, algorithm)
+	return
+}
+
+func (c FsmapCatalog) Keys(ctx context.Context) (keys []string, err error) {
+	if keys, err = readKeys(ctx, filepath.Join(c.path, "keys")); err != nil {
+		return
+	}
+
+	return
+}
+
+func (c FsmapCatalog) indexPath() string {
+	return filepath.Join(c.path, "index")
+}
+
+func (c FsmapCatalog) Index(ctx context.Context) (*CatalogIndex, error) {
+	return c.loadIndex(ctx, true)
+}
+
+func (c FsmapCatalog) loadIndex(ctx context.Context, store bool) (*CatalogIndex, error) {
+	if !store {
+		return loadCatalogIndex(ctx, c.indexPath(), c, nil)
+	}
+	return loadCatalogIndex(ctx, c.indexPath(), c, c.lock)
+}
+
+func (c FsmapCatalog) sourcePath(key string, create bool) (path string, err error) {
+	if path, err = c.fsmap.Lookup([]byte(key), create); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errNoSource(key)
+		}
+		return
+	}
+
+	path = filepath.Join(path, "source.json")
+	return
+}
+
+func (c FsmapCatalog) Lookup(key string) (s Source, err error) {
+	var path string
+	if path, err = c.sourcePath(key, false); err != nil {
+		return
+	}
+
+	if err = decodeJsonFromFile(path, &s); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errNoSource(key)
+		}
+		return
+	}
+
+	return
+}
+
+func (c FsmapCatalog) lock() (func(), error) {
+	return lockCatalog(filepath.Join(c.path, "lock"))
+}
+
+// fsmapBatch writes to a locked FsmapCatalog, updating its index in memory
+// until the batch ends.
+type fsmapBatch struct {
+	c     FsmapCatalog
+	idx   *CatalogIndex
+	dirty bool
+}
+
+// Batch applies the writes fn makes through b under one lock, loading and
+// storing the index once.
+func (c FsmapCatalog) Batch(fn func(b Catalog) error) (err error) {
+	var unlock func()
+	if unlock, err = c.lock(); err != nil {
+		return
+	}
+	defer unlock()
+
+	b := &fsmapBatch{c: c}
+	if b.idx, err = loadCatalogIndex(context.TODO(), c.indexPath(), c, heldLock); err != nil {
+		return
+	}
+
+	// the sources written before a failure stay indexed
+	err = fn(b)
+	if b.dirty {
+		if ierr := encodeJsonToFile(c.indexPath(), b.idx); err == nil {
+			err = ierr
+		}
+	}
+	return
+}
+
+func (c FsmapCatalog) Create(s Source) error {
+	return c.Batch(func(b Catalog) error { return b.Create(s) })
+}
+
+func (c FsmapCatalog) Update(s Source) error {
+	return c.Batch(func(b Catalog) error { return b.Update(s) })
+}
+
+func (c FsmapCatalog) Delete(key string) error {
+	return c.Batch(func(b Catalog) error { return b.Delete(key) })
+}
+
+func (b *fsmapBatch) Keys(ctx context.Context) ([]string, error) {
+	return b.c.Keys(ctx)
+}
+
+func (b *fsmapBatch) Lookup(key string) (Source, error) {
+	return b.c.Lookup(key)
+}
+
+func (b *fsmapBatch) Create(s Source) (err error) {
+	var path string
+	if path, err = b.c.sourcePath(s.Key, true); err != nil {
+		return
+	}
+
+	if err = Output(path).Valid(); err != nil {
+		if errors.Is(err, fs.ErrExist) {
+			return errSourceExists(s.Key)
+		}
+		return fmt.Errorf("mashu.FsmapCatalog.Create: for key '%s': %w", s.Key, err)
+	}
+
+	if err = encodeJsonToFile(path, s); err != nil {
+		return
+	}
+
+	if err = appendKey(filepath.Join(b.c.path, "keys"), s.Key); err != nil {
+		return
+	}
+
+	b.idx.Add(s)
+	b.dirty = true
+	return
+}
+
+func (b *fsmapBatch) Update(s Source) (err error) {
+	var path string
+	if path, err = b.c.sourcePath(s.Key, false); err != nil {
+		return
+	}
+	if _, err = os.Stat(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errNoSource(s.Key)
+		}
+		return
+	}
+
+	if err = encodeJsonToFile(path, s); err != nil {
+		return
+	}
+
+	b.idx.Add(s)
+	b.dirty = true
+	return
+}
+
+func (b *fsmapBatch) Delete(key string) (err error) {
+	var path string
+	if path, err = b.c.sourcePath(key, false); err != nil {
+		return
+	}
+	if err = os.Remove(path); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = errNoSource(key)
+		}
+		return
+	}
+
+	if err = removeKey(filepath.Join(b.c.path, "keys"), key); err != nil {
+		return
+	}
+
+	b.idx.Remove(key)
+	b.dirty = true
+	return
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"time"
+)
+
+type RegionRef struct {
+	Key    string
+	Region int
+}
+
+type TagEntry struct {
+	Regions  []RegionRef
+	Duration Duration
+}
+
+// CatalogIndex maps tags to the regions that carry them, and keeps a copy of
+// every source's regions so that tag filters can be evaluated without loading
+// each source.
+type CatalogIndex struct {
+	Tags    map[string]TagEntry
+	Regions map[string][]TaggedRegion
+	Weights map[string]float64 `json:",omitempty"`
+}
+
+// indexedCatalog is implemented by catalogs that maintain a CatalogIndex.
+type indexedCatalog interface {
+	Index(ctx context.Context) (*CatalogIndex, error)
+}
+
+// indexLoader is implemented by catalogs storing their index in a file; with
+// store false, an index that has to be rebuilt is only kept in memory.
+type indexLoader interface {
+	loadIndex(ctx context.Context, store bool) (*CatalogIndex, error)
+}
+
+// memoryIndexCatalog is a catalog whose index, when it has to be rebuilt, is
+// never stored, so that a dry run writes nothing.
+type memoryIndexCatalog struct {
+	Catalog
+}
+
+func (c memoryIndexCatalog) Index(ctx context.Context) (*CatalogIndex, error) {
+	if l, ok := c.Catalog.(indexLoader); ok {
+		return l.loadIndex(ctx, false)
+	}
+	if ic, ok := c.Catalog.(indexedCatalog); ok {
+		return ic.Index(ctx)
+	}
+	return buildCatalogIndex(ctx, c.Catalog)
+}
+
+func NewCatalogIndex() *CatalogIndex {
+	return &CatalogIndex{
+		Tags:    make(map[string]TagEntry),
+		Regions: make(map[string][]TaggedRegion),
+		Weights: make(map[string]float64),
+	}
+}
+
+func buildCatalogIndex(ctx context.Context, c Catalog) (idx *CatalogIndex, err error) {
+	var keys []string
+	if keys, err = c.Keys(ctx); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	err = nil
+
+	idx = NewCatalogIndex()
+	for _, key := range keys {
+		var s Source
+		if s, err = c.Lookup(key); err != nil {
+			err = fmt.Errorf("mashu.buildCatalogIndex: %w", err)
+			return
+		}
+		idx.Add(s)
+	}
+
+	return
+}
+
+func (idx *CatalogIndex) Add(s Source) {
+	idx.Remove(s.Key)
+
+	idx.Regions[s.Key] = s.Regions
+	if s.Weight != 0 {
+		idx.Weights[s.Key] = s.Weight
+	}
+	for i, r := range s.Regions {
+		for _, tag := range r.Tags {
+			e := idx.Tags[tag]
+			e.Regions = append(e.Regions, RegionRef{s.Key, i})
+			e.Duration = e.Duration.Add(Duration{r.Duration()})
+			idx.Tags[tag] = e
+		}
+	}
+}
+
+func (idx *CatalogIndex) Remove(key string) {
+	regions, ok := idx.Regions[key]
+	if !ok {
+		return
+	}
+	delete(idx.Regions, key)
+	delete(idx.Weights, key)
+
+	for _, r := range regions {
+		for _, tag := range r.Tags {
+			e, ok := idx.Tags[tag]
+			if !ok {
+				continue
+			}
+
+			refs := e.Regions[:0]
+			for _, ref := range e.Regions {
+				if ref.Key != key {
+					refs = append(refs, ref)
+				} else {
+					e.Duration.Duration -= regions[ref.Region].Duration()
+				}
+			}
+			e.Regions = refs
+
+			if len(e.Regions) == 0 {
+				delete(idx.Tags, tag)
+			} else {
+				idx.Tags[tag] = e
+			}
+		}
+	}
+}
+
+// weight returns the sampling weight of the source with key.
+func (idx *CatalogIndex) weight(key string) float64 {
+	return sampleWeight(idx.Weights[key])
+}
+
+// candidates returns the keys that could satisfy g, narrowed through the tag
+// map when g requires tags.
+func (idx *CatalogIndex) candidates(g PlanGeneratorParameters) (keys []string) {
+	if len(g.RequiredTags) == 0 {
+		for key := range idx.Regions {
+			keys = append(keys, key)
+		}
+		return
+	}
+
+	seen := make(map[string]bool)
+	for tag, e := range idx.Tags {
+		if !tagMatches(g.RequiredTags[0], tag) {
+			continue
+		}
+		for _, ref := range e.Regions {
+			if !seen[ref.Key] {
+				seen[ref.Key] = true
+				keys = append(keys, ref.Key)
+			}
+		}
+	}
+	return
+}
+
+// Match returns the keys with at least one region valid for g, along with the
+// duration covered by their valid regions.
+func (idx *CatalogIndex) Match(g PlanGeneratorParameters) (keys []string, durations map[string]time.Duration) {
+	durations = make(map[string]time.Duration)
+	for _, key := range idx.candidates(g) {
+		regions := validRegions(g, idx.Regions[key])
+		if len(regions) == 0 {
+			continue
+		}
+
+		keys = append(keys, key)
+		durations[key] = coveredDuration(regions)
+	}
+
+	sort.Strings(keys)
+	return
+}
+
+// readCatalogIndex reads the index stored at path; ok is false when there is
+// none yet.
+func readCatalogIndex(path string) (idx *CatalogIndex, ok bool, err error) {
+	idx = NewCatalogIndex()
+	if err = decodeJsonFromFile(path, idx); errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("mashu.readCatalogIndex: unable to load index ('%s'): %w", path, err)
+	}
+	return idx, true, nil
+}
+
+// heldLock stands for a catalog lock its caller already holds.
+func heldLock() (func(), error) {
+	return func() {}, nil
+}
+
+// loadCatalogIndex reads the index stored at path, rebuilding it from c when
+// it does not exist yet. The rebuilt index is stored under the catalog lock
+// taken by lock, so as not to race with writers; it is only kept in memory
+// when lock is nil or another process holds the lock.
+func loadCatalogIndex(ctx context.Context, path string, c Catalog, lock func() (func(), error)) (idx *CatalogIndex, err error) {
+	var ok bool
+	if idx, ok, err = readCatalogIndex(path); ok || err != nil {
+		return
+	}
+	if lock == nil {
+		return buildCatalogIndex(ctx, c)
+	}
+
+	var unlock func()
+	if unlock, err = lock(); errors.Is(err, ErrCatalogLocked) {
+		return buildCatalogIndex(ctx, c)
+	} else if err != nil {
+		return
+	}
+	defer unlock()
+
+	// a writer may have stored the index before the lock was taken
+	if idx, ok, err = readCatalogIndex(path); ok || err != nil {
+		return
+	}
+	if idx, err = buildCatalogIndex(ctx, c); err != nil {
+		return
+	}
+
+	err = encodeJsonToFile(path, idx)
+	return
+}
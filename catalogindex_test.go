@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestCatalogIndexReAdd(t *testing.T) {
+	s := Source{Key: "a", Regions: []TaggedRegion{tagged(0, 1000), tagged(10, 30, "op"), tagged(100, 125, "op", "song")}}
+
+	idx := NewCatalogIndex()
+	for i := 0; i < 3; i++ {
+		idx.Add(s)
+		if e := idx.Tags["op"]; len(e.Regions) != 2 || e.Duration != seconds(45) {
+			t.Errorf("op after adding %d times = %d regions lasting %v, want 2 lasting 45s", i+1, len(e.Regions), e.Duration)
+		}
+		if e := idx.Tags["song"]; len(e.Regions) != 1 || e.Duration != seconds(25) {
+			t.Errorf("song after adding %d times = %d regions lasting %v, want 1 lasting 25s", i+1, len(e.Regions), e.Duration)
+		}
+	}
+
+	idx.Add(Source{Key: "b", Regions: []TaggedRegion{tagged(0, 5, "op")}})
+	idx.Remove("a")
+	if e := idx.Tags["op"]; len(e.Regions) != 1 || e.Duration != seconds(5) {
+		t.Errorf("op after removing a = %d regions lasting %v, want 1 lasting 5s", len(e.Regions), e.Duration)
+	}
+	if _, ok := idx.Tags["song"]; ok {
+		t.Error("song still indexed after removing a")
+	}
+}
+
+func TestMemoryIndexCatalog(t *testing.T) {
+	c, err := NewJsonlCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Create(Source{Key: "a", Regions: []TaggedRegion{tagged(0, 10, "op")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(c.indexPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dry run rebuilds the missing index without storing it
+	idx, err := memoryIndexCatalog{c}.Index(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Tags["op"].Regions) != 1 {
+		t.Errorf("rebuilt index %v, want op indexed", idx.Tags)
+	}
+	if _, err = os.Stat(c.indexPath()); !os.IsNotExist(err) {
+		t.Errorf("index stored by a dry run: %v", err)
+	}
+
+	if _, err = c.Index(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(c.indexPath()); err != nil {
+		t.Errorf("rebuilt index not stored: %v", err)
+	}
+}
+
+func TestCatalogIndexLocked(t *testing.T) {
+	c, err := NewJsonlCatalog(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Create(Source{Key: "a", Regions: []TaggedRegion{tagged(0, 10, "op")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(c.indexPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// while a writer holds the lock, readers leave the index to it
+	unlock, err := c.lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Index(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(c.indexPath()); !os.IsNotExist(err) {
+		t.Errorf("index stored while the catalog was locked: %v", err)
+	}
+	unlock()
+
+	if _, err = c.Index(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(c.indexPath()); err != nil {
+		t.Errorf("rebuilt index not stored: %v", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// JsonlCatalog stores every source as one JSON line of a single file. It
+// needs no external libraries, at the cost of reading the whole file for
+// each operation or batch of them.
+type JsonlCatalog struct {
+	path string
+}
+
+// NewJsonlCatalog opens the catalog file at path; if path is a directory the
+// catalog is kept in sources.jsonl inside it. The tag index is kept next to
+// the catalog file with an .index suffix, and writers hold an advisory lock
+// on a .lock file beside it.
+func NewJsonlCatalog(path string) (c *JsonlCatalog, err error) {
+	if fi, statErr := os.Stat(path); statErr == nil && fi.IsDir() {
+		path = filepath.Join(path, "sources.jsonl")
+	}
+
+	c = &JsonlCatalog{path: path}
+	return
+}
+
+func (c JsonlCatalog) load(ctx context.Context) (sources []Source, err error) {
+	var f *os.File
+	if f, err = os.Open(c.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	defer f.Close()
+
+	d := json.NewDecoder(f)
+	for d.More() {
+		var s Source
+		if err = d.Decode(&s); err != nil {
+			err = fmt.Errorf("mashu.JsonlCatalog.load: error decoding '%s': %w", c.path, err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			err = context.Canceled
+			return
+		default:
+			sources = append(sources, s)
+		}
+	}
+
+	return
+}
+
+func (c JsonlCatalog) store(sources []Source) error {
+	o := make([]any, len(sources))
+	for i, s := range sources {
+		o[i] = s
+	}
+
+	return encodeJsonToFile(c.path, o...)
+}
+
+func (c JsonlCatalog) indexPath() string {
+	return c.path + ".index"
+}
+
+func (c JsonlCatalog) Index(ctx context.Context) (*CatalogIndex, error) {
+	return c.loadIndex(ctx, true)
+}
+
+func (c JsonlCatalog) loadIndex(ctx context.Context, store bool) (*CatalogIndex, error) {
+	if !store {
+		return loadCatalogIndex(ctx, c.indexPath(), c, nil)
+	}
+	return loadCatalogIndex(ctx, c.indexPath(), c, c.lock)
+}
+
+func (c JsonlCatalog) lock() (func(), error) {
+	return lockCatalog(c.path + ".lock")
+}
+
+func (c JsonlCatalog) Keys(ctx context.Context) (keys []string, err error) {
+	var sources []Source
+	if sources, err = c.load(ctx); err != nil {
+		return
+	}
+
+	for _, s := range sources {
+		keys = append(keys, s.Key)
+	}
+
+	return
+}
+
+func (c JsonlCatalog) Lookup(key string) (s Source, err error) {
+	var sources []Source
+	if sources, err = c.load(context.TODO()); err != nil {
+		return
+	}
+
+	for _, s = range sources {
+		if s.Key == key {
+			return
+		}
+	}
+
+	return Source{}, errNoSource(key)
+}
+
+// jsonlBatch holds the sources and index of a locked JsonlCatalog in memory
+// until the batch ends.
+type jsonlBatch struct {
+	c       JsonlCatalog
+	sources []Source
+	idx     *CatalogIndex
+	dirty   bool
+}
+
+// Batch applies the writes fn makes through b under one lock, loading and
+// storing the catalog file and its index once.
+func (c JsonlCatalog) Batch(fn func(b Catalog) error) (err error) {
+	var unlock func()
+	if unlock, err = c.lock(); err != nil {
+		return
+	}
+	defer unlock()
+
+	b := &jsonlBatch{c: c}
+	if b.sources, err = c.load(context.TODO()); err != nil {
+		return
+	}
+	if b.idx, err = loadCatalogIndex(context.TODO(), c.indexPath(), b, heldLock); err != nil {
+		return
+	}
+
+	// the writes made before a failure are stored
+	err = fn(b)
+	if b.dirty {
+		if serr := c.store(b.sources); serr != nil {
+			return serr
+		}
+		if ierr := encodeJsonToFile(c.indexPath(), b.idx); err == nil {
+			err = ierr
+		}
+	}
+	return
+}
+
+func (c JsonlCatalog) Create(s Source) error {
+	return c.Batch(func(b Catalog) error { return b.Create(s) })
+}
+
+func (c JsonlCatalog) Update(s Source) error {
+	return c.Batch(func(b Catalog) error { return b.Update(s) })
+}
+
+func (c JsonlCatalog) Delete(key string) error {
+	return c.Batch(func(b Catalog) error { return b.Delete(key) })
+}
+
+func (b *jsonlBatch) find(key string) int {
+	for i, s := range b.sources {
+		if s.Key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *jsonlBatch) Keys(ctx context.Context) (keys []string, err error) {
+	for _, s := range b.sources {
+		keys = append(keys, s.Key)
+	}
+	return
+}
+
+func (b *jsonlBatch) Lookup(key string) (Source, error) {
+	i := b.find(key)
+	if i < 0 {
+		return Source{}, errNoSource(key)
+	}
+	return clone(b.sources[i]), nil
+}
+
+func (b *jsonlBatch) Create(s Source) error {
+	if b.find(s.Key) >= 0 {
+		return errSourceExists(s.Key)
+	}
+
+	s = clone(s)
+	b.sources = append(b.sources, s)
+	b.idx.Add(s)
+	b.dirty = true
+	return nil
+}
+
+func (b *jsonlBatch) Update(s Source) error {
+	i := b.find(s.Key)
+	if i < 0 {
+		return errNoSource(s.Key)
+	}
+
+	s = clone(s)
+	b.sources[i] = s
+	b.idx.Add(s)
+	b.dirty = true
+	return nil
+}
+
+func (b *jsonlBatch) Delete(key string) error {
+	i := b.find(key)
+	if i < 0 {
+		return errNoSource(key)
+	}
+
+	b.sources = append(b.sources[:i], b.sources[i+1:]...)
+	b.idx.Remove(key)
+	b.dirty = true
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryCatalog keeps sources in memory; it is intended for tests and
+// throwaway catalogs.
+type MemoryCatalog struct {
+	mu      sync.Mutex
+	keys    []string
+	sources map[string]Source
+	index   *CatalogIndex
+}
+
+// clone copies the parts of s that callers commonly modify in place, so that
+// stored sources and the index are not changed behind the catalog's back.
+func clone(s Source) Source {
+	regions := make([]TaggedRegion, len(s.Regions))
+	for i, r := range s.Regions {
+		regions[i] = r
+		regions[i].Tags = append([]string(nil), r.Tags...)
+	}
+	s.Regions = regions
+	if s.Media != nil {
+		media := make(map[Input]Fingerprint)
+		for k, v := range s.Media {
+			media[k] = v
+		}
+		s.Media = media
+	}
+	if s.Metadata != nil {
+		metadata := make(map[string]string)
+		for k, v := range s.Metadata {
+			metadata[k] = v
+		}
+		s.Metadata = metadata
+	}
+	return s
+}
+
+func NewMemoryCatalog(sources ...Source) (c *MemoryCatalog, err error) {
+	c = &MemoryCatalog{sources: make(map[string]Source), index: NewCatalogIndex()}
+	for _, s := range sources {
+		if err = c.Create(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *MemoryCatalog) Keys(ctx context.Context) (keys []string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys = append(keys, c.keys...)
+	return
+}
+
+func (c *MemoryCatalog) Index(ctx context.Context) (*CatalogIndex, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.index, nil
+}
+
+func (c *MemoryCatalog) Lookup(key string) (s Source, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ok bool
+	if s, ok = c.sources[key]; !ok {
+		err = errNoSource(key)
+	}
+	s = clone(s)
+	return
+}
+
+func (c *MemoryCatalog) Create(s Source) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sources[s.Key]; ok {
+		return errSourceExists(s.Key)
+	}
+	s = clone(s)
+	c.sources[s.Key] = s
+	c.keys = append(c.keys, s.Key)
+	c.index.Add(s)
+	return nil
+}
+
+func (c *MemoryCatalog) Update(s Source) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sources[s.Key]; !ok {
+		return errNoSource(s.Key)
+	}
+	s = clone(s)
+	c.sources[s.Key] = s
+	c.index.Add(s)
+	return nil
+}
+
+func (c *MemoryCatalog) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.sources[key]; !ok {
+		return errNoSource(key)
+	}
+	delete(c.sources, key)
+	c.index.Remove(key)
+	for i, k := range c.keys {
+		if k == key {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestMemoryCatalog(t *testing.T) {
+	c, err := NewMemoryCatalog(Source{Key: "a"}, Source{Key: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Create(Source{Key: "a"}); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Create of an existing key: %v, want fs.ErrExist", err)
+	}
+	if err = c.Update(Source{Key: "c"}); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Update of a missing key: %v, want fs.ErrNotExist", err)
+	}
+
+	if err = c.Update(Source{Key: "b", Regions: []TaggedRegion{{Tags: []string{"op"}}}}); err != nil {
+		t.Fatal(err)
+	}
+	if s, err := c.Lookup("b"); err != nil || len(s.Regions) != 1 {
+		t.Errorf("Lookup after Update = %v, %v, want the updated source", s, err)
+	}
+
+	if err = c.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Lookup("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Lookup of a deleted key: %v, want fs.ErrNotExist", err)
+	}
+
+	keys, err := c.Keys(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"b"}) {
+		t.Errorf("Keys = %v, want [b]", keys)
+	}
+}
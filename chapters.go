@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ChapterRule adds Tags to chapter regions whose title matches the regular
+// expression Match.
+type ChapterRule struct {
+	Match string
+	Tags  []string
+
+	match *regexp.Regexp
+}
+
+type probeChapter struct {
+	StartTime string `json:"start_time"`
+	EndTime   string `json:"end_time"`
+	Tags      struct {
+		Title string `json:"title"`
+	} `json:"tags"`
+}
+
+func loadChapterRules(path string) (rules []ChapterRule, err error) {
+	if path == "" {
+		return
+	}
+
+	if err = decodeJsonFromFile(path, &rules); err != nil {
+		err = fmt.Errorf("mashu.loadChapterRules: unable to load rules ('%s'): %w", path, err)
+		return
+	}
+
+	for i := range rules {
+		if rules[i].match, err = regexp.Compile(rules[i].Match); err != nil {
+			err = fmt.Errorf("mashu.loadChapterRules: bad expression '%s': %w", rules[i].Match, err)
+			return
+		}
+	}
+
+	return
+}
+
+var chapterTagRegexp = regexp.MustCompile(`[^a-z0-9]+`)
+
+// normalizeChapterTitle lowercases a title and joins its words with dashes,
+// so "Part A" becomes "part-a".
+func normalizeChapterTitle(title string) string {
+	return strings.Trim(chapterTagRegexp.ReplaceAllString(strings.ToLower(title), "-"), "-")
+}
+
+func parseChapterTime(s string) (d Duration, err error) {
+	if d.Duration, err = time.ParseDuration(s + "s"); err != nil {
+		err = fmt.Errorf("mashu.parseChapterTime: bad chapter time '%s': %w", s, err)
+	}
+	return
+}
+
+// chapterRegions returns a region per chapter, tagged with the normalized
+// chapter title and the tags of every matching rule.
+func chapterRegions(chapters []probeChapter, rules []ChapterRule) (regions []TaggedRegion, err error) {
+	for _, c := range chapters {
+		var r TaggedRegion
+		if r.Start, err = parseChapterTime(c.StartTime); err != nil {
+			return
+		}
+		if r.End, err = parseChapterTime(c.EndTime); err != nil {
+			return
+		}
+		if r.Valid() != nil {
+			continue
+		}
+
+		if tag := normalizeChapterTitle(c.Tags.Title); tag != "" {
+			r.Tags = append(r.Tags, tag)
+		}
+		for _, rule := range rules {
+			if rule.match.MatchString(c.Tags.Title) {
+				r.Tags = append(r.Tags, rule.Tags...)
+			}
+		}
+
+		regions = append(regions, r)
+	}
+
+	return
+}
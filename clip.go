@@ -12,6 +12,8 @@ import (
 
 // assumes inputs have already been validated
 func renderClip(ctx context.Context, f Format, s Source, r Region, o Output) (err error) {
+	s = s.WithLanguages(f)
+
 	args := make([]string, 0)
 	filters := make([]string, 0)
 
@@ -7,7 +7,7 @@ import (
 )
 
 // assumes inputs are validated and input files are the same format
-func renderConcat(ctx context.Context, f Format, o Output, i []Input) error {
+func renderConcat(ctx context.Context, f Format, o Output, d *Duration, i []Input) error {
 	l := len(i)
 	args := make([]string, 2*l)
 	for n, p := range i {
@@ -18,6 +18,9 @@ func renderConcat(ctx context.Context, f Format, o Output, i []Input) error {
 	args = append(args,
 		"-filter_complex", fmt.Sprintf(
 			"concat=n=%d:v=1:a=1", l))
+	if d != nil {
+		args = append(args, "-t", fmt.Sprintf("%dus", d.Microseconds()))
+	}
 
 	// configure output
 	switch f.VideoCodec {
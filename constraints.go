@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// generatorHistory records what has been generated so far, so that the
+// generator's repetition constraints can be enforced.
+type generatorHistory struct {
+	recent  []string            // keys of the generated clips, newest last
+	used    map[string][]Region // spans used from each source
+	tagRuns map[string]uint     // consecutive segments carrying each tag
+	tags    []string            // tags of the current segment's clips
+	open    bool                // clips were recorded for the current segment
+	// number of the recent clips replayed from an extended generation
+	replayed int
+	// keys used by the finished generated cells of each enclosing stack
+	// with UniqueStackSources, innermost last
+	stacks []map[string]bool
+}
+
+func newGeneratorHistory() *generatorHistory {
+	return &generatorHistory{
+		used:    make(map[string][]Region),
+		tagRuns: make(map[string]uint),
+	}
+}
+
+// record notes that a clip of span from key, picked from a region carrying
+// tags, was generated for the current segment.
+func (h *generatorHistory) record(key string, span Region, tags []string) {
+	h.recent = append(h.recent, key)
+	h.used[key] = append(h.used[key], span)
+	h.tags = append(h.tags, tags...)
+	h.open = true
+}
+
+// next ends the current segment; clips of a stack or blend count as one step
+// of a tag run. Segments already ended by a nested generator are not counted
+// again.
+func (h *generatorHistory) next() {
+	if !h.open {
+		return
+	}
+	h.open = false
+
+	runs := make(map[string]uint)
+	for _, tag := range h.tags {
+		runs[tag] = h.tagRuns[tag] + 1
+	}
+	h.tagRuns = runs
+	h.tags = nil
+}
+
+// repeats reports whether key was among the last gap clips generated.
+func (h *generatorHistory) repeats(key string, gap uint) bool {
+	for i := len(h.recent) - 1; i >= 0 && i >= len(h.recent)-int(gap); i-- {
+		if h.recent[i] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// inStack reports whether key was used by another cell of an enclosing stack
+// with UniqueStackSources.
+func (h *generatorHistory) inStack(key string) bool {
+	for _, stack := range h.stacks {
+		if stack[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// usableRegions returns the valid regions of s that may still be used: with
+// NoRegionOverlap previously used spans are carved out, and with MaxTagRun
+// regions carrying a tag that has reached the limit are dropped.
+func (h *generatorHistory) usableRegions(g PlanGeneratorParameters, s Source) (usable []TaggedRegion) {
+region:
+	for _, r := range validRegions(g, s.Regions) {
+		if g.MaxTagRun > 0 {
+			for _, tag := range r.Tags {
+				if h.tagRuns[tag] >= g.MaxTagRun {
+					continue region
+				}
+			}
+		}
+
+		if !g.NoRegionOverlap {
+			usable = append(usable, r)
+			continue
+		}
+		for _, part := range r.Region.Subtract(h.used[s.Key]) {
+			if part.Duration() > 0 && part.Duration() >= g.Alignment.Duration {
+				r.Region = part
+				usable = append(usable, r)
+			}
+		}
+	}
+
+	return
+}
+
+// nextRegion returns the earliest part of regions after the last span used
+// from key, so that the clips of a source follow each other in time; once
+// none at least as long as the alignment is left, it starts over with the
+// earliest region.
+func (h *generatorHistory) nextRegion(g PlanGeneratorParameters, key string, regions []TaggedRegion) TaggedRegion {
+	sorted := append([]TaggedRegion(nil), regions...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Start.Duration < sorted[j].Start.Duration })
+
+	if used := h.used[key]; len(used) > 0 {
+		last := used[len(used)-1]
+		for _, r := range sorted {
+			for _, part := range r.Region.Subtract([]Region{Region{End: last.End}}) {
+				if part.Duration() > 0 && part.Duration() >= g.Alignment.Duration {
+					r.Region = part
+					return r
+				}
+			}
+		}
+	}
+	return sorted[0]
+}
+
+// constraintError explains why no source could be pulled.
+func (g PlanGeneratorParameters) constraintError(matching int) error {
+	return fmt.Errorf("mashu.PlanGeneratorParameters: none of the %d matching sources satisfies the generator constraints "+
+		"(RepeatGap %d, UniqueStackSources %v, NoRegionOverlap %v, MaxTagRun %d); "+
+		"relax the constraints or widen the tag filters",
+		matching, g.RepeatGap, g.UniqueStackSources, g.NoRegionOverlap, g.MaxTagRun)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProject returns a project generating from generator over n memory
+// cataloged sources a, b, ... lasting d, tagged ta and tb in turn.
+func testProject(t *testing.T, generator string, n int, d time.Duration) Project {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "plan"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "generator.json"), []byte(generator), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var sources []Source
+	for i := 0; i < n; i++ {
+		sources = append(sources, Source{
+			Key:     string(rune('a' + i)),
+			Regions: []TaggedRegion{{Region: Region{End: Duration{d}}, Tags: []string{"t" + string(rune('a'+i%2))}}},
+		})
+	}
+	c, err := NewMemoryCatalog(sources...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Project{Path: dir, Catalog: c, Format: DefaultFormat}
+}
+
+// generatedClips returns the clips of gen in the order they were generated.
+func generatedClips(gen *Generation) (clips []PlanClip) {
+	for _, name := range gen.committed() {
+		if clip := gen.plans[name].Clip; clip != nil {
+			clips = append(clips, *clip)
+		}
+	}
+	return
+}
+
+func TestGeneratorConstraints(t *testing.T) {
+	tests := []struct {
+		name      string
+		generator string
+		sources   int
+		duration  time.Duration
+		err       string
+		check     func(clips []PlanClip) bool
+	}{
+		{
+			"repeat gap",
+			`{"Target":"60s","Alignment":"1s","MaxConcat":4,"RepeatGap":2,"Segments":[{"Clip":{"Start":"5s","End":"5s"},"Tickets":1}]}`,
+			3, time.Minute, "",
+			func(clips []PlanClip) bool {
+				for i := range clips {
+					for j := i - 2; j < i; j++ {
+						if j >= 0 && *clips[j].SrcKey == *clips[i].SrcKey {
+							return false
+						}
+					}
+				}
+				return true
+			},
+		},
+		{
+			"repeat gap unsatisfiable",
+			`{"Target":"60s","Alignment":"1s","MaxConcat":4,"RepeatGap":3,"Segments":[{"Clip":{"Start":"5s","End":"5s"},"Tickets":1}]}`,
+			3, time.Minute, "RepeatGap 3", nil,
+		},
+		{
+			"no region overlap",
+			`{"Target":"60s","Alignment":"1s","MaxConcat":4,"NoRegionOverlap":true,"Segments":[{"Clip":{"Start":"5s","End":"5s"},"Tickets":1}]}`,
+			3, time.Minute, "",
+			func(clips []PlanClip) bool {
+				for i := range clips {
+					for j := 0; j < i; j++ {
+						if *clips[j].SrcKey == *clips[i].SrcKey &&
+							clips[j].Region.Start.Duration < clips[i].Region.End.Duration &&
+							clips[i].Region.Start.Duration < clips[j].Region.End.Duration {
+							return false
+						}
+					}
+				}
+				return true
+			},
+		},
+		{
+			"no region overlap exhausted",
+			`{"Target":"200s","Alignment":"1s","MaxConcat":4,"NoRegionOverlap":true,"Segments":[{"Clip":{"Start":"5s","End":"5s"},"Tickets":1}]}`,
+			3, 20 * time.Second, "NoRegionOverlap true", nil,
+		},
+		{
+			"max tag run",
+			`{"Target":"60s","Alignment":"1s","MaxConcat":4,"MaxTagRun":1,"Segments":[{"Clip":{"Start":"5s","End":"5s"},"Tickets":1}]}`,
+			4, time.Minute, "",
+			func(clips []PlanClip) bool {
+				for i := 1; i < len(clips); i++ {
+					// sources alternate between tags ta and tb
+					if (*clips[i].SrcKey)[0]%2 == (*clips[i-1].SrcKey)[0]%2 {
+						return false
+					}
+				}
+				return true
+			},
+		},
+		{
+			"unique stack sources",
+			`{"Target":"60s","Alignment":"1s","MaxConcat":4,"UniqueStackSources":true,"Segments":[{"Stack":{"Count":3,"Duration":{"Start":"5s","End":"5s"}},"Tickets":1}]}`,
+			3, time.Minute, "",
+			func(clips []PlanClip) bool {
+				for i := 0; i+2 < len(clips); i += 3 {
+					a, b, c := *clips[i].SrcKey, *clips[i+1].SrcKey, *clips[i+2].SrcKey
+					if a == b || b == c || a == c {
+						return false
+					}
+				}
+				return true
+			},
+		},
+	}
+
+	for _, test := range tests {
+		gen, err := testProject(t, test.generator, test.sources, test.duration).Generate(nil)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want one mentioning %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if clips := generatedClips(gen); len(clips) == 0 || !test.check(clips) {
+			t.Errorf("%s: constraint broken by %v", test.name, clips)
+		}
+	}
+}
+
+func TestGeneratorSeed(t *testing.T) {
+	generator := `{"Target":"60s","Alignment":"1s","MaxConcat":3,"Seed":42,"Segments":[{"Clip":{"Start":"3s","End":"9s"},"Tickets":1}]}`
+
+	var previous []PlanClip
+	for i := 0; i < 2; i++ {
+		gen, err := testProject(t, generator, 5, time.Minute).Generate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clips := generatedClips(gen)
+		for j := range previous {
+			if *clips[j].SrcKey != *previous[j].SrcKey || clips[j].Region != previous[j].Region {
+				t.Fatalf("seeded generations differ: %v and %v", previous, clips)
+			}
+		}
+		previous = clips
+	}
+}
+
+func TestGeneratorNestedSegments(t *testing.T) {
+	generator := `{"Target":"60s","Alignment":"1s","MaxConcat":3,"Segments":[{"Sequence":{"Target":"6s"},"Tickets":1}]}`
+	if _, err := testProject(t, generator, 5, time.Minute).Generate(nil); err == nil {
+		t.Error("sequence without segments generated, want an error")
+	}
+}
+
+func TestGeneratorOrdered(t *testing.T) {
+	generator := `{"Alignment":"1s","MaxConcat":3,"Mode":"ordered","ClipsPerSource":2,"RepeatGap":1,"Segments":[{"Clip":{"Start":"2s","End":"3s"},"Tickets":1}]}`
+	gen, err := testProject(t, generator, 4, time.Minute).Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a source waits while it would repeat
+	var keys string
+	for _, clip := range generatedClips(gen) {
+		keys += *clip.SrcKey
+	}
+	if keys != "ababcdcd" {
+		t.Errorf("ordered clips from %s, want ababcdcd", keys)
+	}
+
+	// the last source's second clip has none left to wait for; rather than
+	// contributing fewer clips, the generation fails
+	if _, err = testProject(t, generator, 3, time.Minute).Generate(nil); err == nil || !strings.Contains(err.Error(), "RepeatGap 1") {
+		t.Errorf("error %v, want one mentioning RepeatGap 1", err)
+	}
+}
+
+func TestGeneratorOrderedLeftovers(t *testing.T) {
+	// the last clips of a source fit in what is left of it only in part;
+	// leftovers shorter than the alignment must not become clips
+	generator := `{"Alignment":"1s","MaxConcat":3,"Mode":"ordered","ClipsPerSource":3,"Segments":[{"Clip":{"Start":"4s","End":"4s"},"Tickets":1}]}`
+	for seed := int64(0); seed < 20; seed++ {
+		gen, err := testProject(t, generator, 1, 10500*time.Millisecond).Generate(&seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, clip := range generatedClips(gen) {
+			if err = clip.Region.Valid(); err != nil {
+				t.Errorf("seed %d: %v", seed, err)
+			}
+		}
+	}
+}
+
+func TestGeneratorUniqueStackCells(t *testing.T) {
+	generator := `{"Target":"20s","Alignment":"1s","MaxConcat":4,"UniqueStackSources":true,"Segments":[{"Stack":{"Count":2,"Duration":{"Start":"2s","End":"2s"},
+		"Cells":{"Segments":[{"Clip":{"Start":"1s","End":"1s"},"Tickets":1}]}},"Tickets":1}]}`
+
+	for seed := int64(0); seed < 30; seed++ {
+		gen, err := testProject(t, generator, 3, time.Minute).Generate(&seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys func(name string, k map[string]bool)
+		keys = func(name string, k map[string]bool) {
+			plan := gen.plans[name]
+			if plan.Clip != nil {
+				k[*plan.Clip.SrcKey] = true
+			}
+			for _, input := range plan.inputs() {
+				keys(input, k)
+			}
+		}
+		for _, name := range gen.committed() {
+			stack := gen.plans[name].Stack
+			if stack == nil {
+				continue
+			}
+			// a cell may repeat a source, but no other cell may use it
+			seen := make(map[string]bool)
+			for _, cell := range stack.Input {
+				k := make(map[string]bool)
+				keys(cell, k)
+				for key := range k {
+					if seen[key] {
+						t.Errorf("seed %d: stack %s uses %s in several cells", seed, name, key)
+					}
+					seen[key] = true
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const proposalAlignment = time.Millisecond
+
+// DetectOptions holds the thresholds of the detection filters.
+type DetectOptions struct {
+	// scdet score (0-100) above which a frame starts a new scene
+	SceneThreshold float64
+	// scenes shorter than this are not proposed
+	SceneMinimum time.Duration
+	// minimum length of a black region
+	BlackMinimum time.Duration
+	// level under which audio is silent (e.g. -50dB)
+	SilenceNoise string
+	// minimum length of a quiet region
+	SilenceMinimum time.Duration
+}
+
+var DefaultDetectOptions = DetectOptions{
+	SceneThreshold: 10.0,
+	SceneMinimum:   2 * time.Second,
+	BlackMinimum:   500 * time.Millisecond,
+	SilenceNoise:   "-50dB",
+	SilenceMinimum: time.Second,
+}
+
+var (
+	sceneRegexp        = regexp.MustCompile(`lavfi\.scd\.time: *([0-9.]+)`)
+	blackRegexp        = regexp.MustCompile(`black_start: *([0-9.]+) +black_end: *([0-9.]+)`)
+	silenceStartRegexp = regexp.MustCompile(`silence_start: *(-?[0-9.]+)`)
+	silenceEndRegexp   = regexp.MustCompile(`silence_end: *([0-9.]+)`)
+)
+
+func parseSeconds(s string) Duration {
+	f, _ := strconv.ParseFloat(s, 64)
+	if f < 0 {
+		f = 0
+	}
+	return Duration{time.Duration(f * float64(time.Second)).Truncate(proposalAlignment)}
+}
+
+// analyze runs the scene, black and silence detection filters over the
+// source's tracks and returns ffmpeg's log output.
+func analyze(ctx context.Context, s Source, o DetectOptions) (output []byte, err error) {
+	args := []string{"-hide_banner", "-nostats", "-loglevel", "info"}
+	filters := ""
+	maps := []string{}
+
+	input := 0
+	if s.Video != nil {
+		args = append(args, "-i", string(s.Video.Path))
+		filters += fmt.Sprintf("[%d:v:%d]blackdetect=d=%g,scdet=threshold=%g[v];",
+			input, s.Video.Track, o.BlackMinimum.Seconds(), o.SceneThreshold)
+		maps = append(maps, "-map", "[v]")
+		input += 1
+	}
+	if s.Audio != nil {
+		args = append(args, "-i", string(s.Audio.Path))
+		filters += fmt.Sprintf("[%d:a:%d]silencedetect=noise=%s:duration=%g[a];",
+			input, s.Audio.Track, o.SilenceNoise, o.SilenceMinimum.Seconds())
+		maps = append(maps, "-map", "[a]")
+		input += 1
+	}
+	if input == 0 {
+		return
+	}
+
+	args = append(args, "-filter_complex", filters[:len(filters)-1])
+	args = append(args, maps...)
+	args = append(args, "-f", "null", "-")
+
+	var buffer bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Stderr = &buffer
+	if err = cmd.Run(); err != nil {
+		err = fmt.Errorf("mashu.analyze: ffmpeg failed for '%s': %w", s.Key, err)
+		return
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// parseProposals converts detection output into regions tagged scene, black
+// and quiet; end bounds regions left open at the end of the media. Scenes
+// shorter than sceneMinimum are left out.
+func parseProposals(output []byte, end Duration, sceneMinimum time.Duration) (regions []TaggedRegion) {
+	var cuts []Duration
+	var silenceStart *Duration
+
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		l := s.Text()
+		if m := sceneRegexp.FindStringSubmatch(l); m != nil {
+			cuts = append(cuts, parseSeconds(m[1]))
+		} else if m := blackRegexp.FindStringSubmatch(l); m != nil {
+			regions = append(regions, TaggedRegion{
+				Region: Region{parseSeconds(m[1]), parseSeconds(m[2])},
+				Tags:   []string{"black"},
+			})
+		} else if m := silenceStartRegexp.FindStringSubmatch(l); m != nil {
+			d := parseSeconds(m[1])
+			silenceStart = &d
+		} else if m := silenceEndRegexp.FindStringSubmatch(l); m != nil && silenceStart != nil {
+			regions = append(regions, TaggedRegion{
+				Region: Region{*silenceStart, parseSeconds(m[1])},
+				Tags:   []string{"quiet"},
+			})
+			silenceStart = nil
+		}
+	}
+	if silenceStart != nil {
+		regions = append(regions, TaggedRegion{
+			Region: Region{*silenceStart, end},
+			Tags:   []string{"quiet"},
+		})
+	}
+
+	sort.Slice(cuts, func(i, j int) bool { return cuts[i].Duration < cuts[j].Duration })
+	start := Duration{}
+	for _, cut := range append(cuts, end) {
+		if cut.Duration-start.Duration >= sceneMinimum {
+			regions = append(regions, TaggedRegion{
+				Region: Region{start, cut},
+				Tags:   []string{"scene"},
+			})
+		}
+		start = cut
+	}
+
+	valid := regions[:0]
+	for _, r := range regions {
+		if r.Valid() == nil && r.End.Duration <= end.Duration {
+			valid = append(valid, r)
+		}
+	}
+
+	sort.SliceStable(valid, func(i, j int) bool { return valid[i].Start.Duration < valid[j].Start.Duration })
+	return valid
+}
+
+// proposeRegions appends candidate regions detected in the source's media,
+// which lasts until end, after its existing regions.
+func proposeRegions(ctx context.Context, s *Source, end Duration, o DetectOptions) (err error) {
+	var output []byte
+	if output, err = analyze(ctx, *s, o); err != nil {
+		return
+	}
+
+	s.Regions = append(s.Regions, parseProposals(output, end, o.SceneMinimum)...)
+	return
+}
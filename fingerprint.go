@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var ErrMediaChanged = errors.New("media changed since cataloging")
+
+// size of each sampled chunk; the hash covers the start, middle and end of a
+// file rather than all of it
+const fingerprintChunk = 1 << 16
+
+type Fingerprint struct {
+	Size     int64
+	ModTime  time.Time
+	Hash     string
+	Duration *Duration `json:",omitempty"`
+}
+
+func hashMedia(f *os.File, size int64) (string, error) {
+	h := sha256.New()
+	binary.Write(h, binary.LittleEndian, size)
+
+	b := make([]byte, fingerprintChunk)
+	for _, offset := range []int64{0, size/2 - fingerprintChunk/2, size - fingerprintChunk} {
+		if offset < 0 {
+			offset = 0
+		}
+		n, err := f.ReadAt(b, offset)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		h.Write(b[:n])
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func NewFingerprint(path Input) (fp Fingerprint, err error) {
+	var f *os.File
+	if f, err = os.Open(string(path)); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+
+	fp.Size = fi.Size()
+	fp.ModTime = fi.ModTime()
+	if fp.Hash, err = hashMedia(f, fp.Size); err != nil {
+		err = fmt.Errorf("mashu.NewFingerprint: unable to hash '%s': %w", path, err)
+		return
+	}
+
+	// not every referenced file has a duration (external subtitles, fonts)
+	if r, err := ffprobe(string(path)); err == nil {
+		if d, err := r.Duration(); err == nil {
+			fp.Duration = &d
+		}
+	}
+
+	return
+}
+
+// Matches reports whether the file at path still has this fingerprint. Files
+// whose size and modification time are unchanged are not rehashed; a file
+// only touched since has its new modification time set in current.
+func (fp Fingerprint) Matches(path Input) (current Fingerprint, err error) {
+	current = fp
+
+	var f *os.File
+	if f, err = os.Open(string(path)); err != nil {
+		return
+	}
+	defer f.Close()
+
+	var fi os.FileInfo
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+
+	if fi.Size() != fp.Size {
+		err = fmt.Errorf("mashu.Fingerprint.Matches: '%s' size changed from %d to %d: %w", path, fp.Size, fi.Size(), ErrMediaChanged)
+		return
+	}
+	if fi.ModTime().Equal(fp.ModTime) {
+		return
+	}
+
+	var hash string
+	if hash, err = hashMedia(f, fi.Size()); err != nil {
+		return
+	}
+	if hash != fp.Hash {
+		err = fmt.Errorf("mashu.Fingerprint.Matches: '%s' content changed: %w", path, ErrMediaChanged)
+		return
+	}
+
+	current.ModTime = fi.ModTime()
+	return
+}
+
+func (s Source) mediaPaths() (paths []Input) {
+	seen := make(map[Input]bool)
+	tracks := []*Track{s.Video, s.Audio, s.Subtitle}
+	for i := range s.AudioAlternatives {
+		tracks = append(tracks, &s.AudioAlternatives[i])
+	}
+	for i := range s.SubtitleAlternatives {
+		tracks = append(tracks, &s.SubtitleAlternatives[i])
+	}
+	for _, t := range tracks {
+		if t != nil && !seen[t.Path] {
+			seen[t.Path] = true
+			paths = append(paths, t.Path)
+		}
+	}
+	return
+}
+
+// Fingerprint records the fingerprint of every file referenced by the source.
+func (s *Source) Fingerprint() (err error) {
+	s.Media = make(map[Input]Fingerprint)
+	for _, path := range s.mediaPaths() {
+		if s.Media[path], err = NewFingerprint(path); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// CheckMedia returns an error wrapping ErrMediaChanged if a referenced file no
+// longer matches its recorded fingerprint. Sources cataloged without
+// fingerprints always pass. Files that were touched but still match have
+// their fingerprints refreshed, reported by touched so that the source can
+// be stored and the files are not rehashed again.
+func (s *Source) CheckMedia() (touched bool, err error) {
+	for _, path := range s.mediaPaths() {
+		fp, ok := s.Media[path]
+		if !ok {
+			continue
+		}
+
+		var current Fingerprint
+		if current, err = fp.Matches(path); err != nil {
+			return false, fmt.Errorf("mashu.Source.CheckMedia: for key '%s': %w", s.Key, err)
+		}
+		if !current.ModTime.Equal(fp.ModTime) {
+			s.Media[path] = current
+			touched = true
+		}
+	}
+	return
+}
+
+// RefreshMedia fingerprints the source's files again and adjusts its regions
+// to the new media: "rescale" stretches every region by the change in
+// duration of the primary file, "invalidate" replaces the regions with a
+// single full-length region.
+func (s *Source) RefreshMedia(mode string) (err error) {
+	paths := s.mediaPaths()
+	if len(paths) == 0 {
+		return
+	}
+
+	old, hadOld := s.Media[paths[0]]
+	if err = s.Fingerprint(); err != nil {
+		return
+	}
+	current := s.Media[paths[0]]
+
+	switch mode {
+	case "rescale":
+		if !hadOld || old.Duration == nil || current.Duration == nil || old.Duration.Duration == 0 {
+			return fmt.Errorf("mashu.Source.RefreshMedia: unable to rescale '%s': unknown previous or current duration", s.Key)
+		}
+		scale := float64(current.Duration.Duration) / float64(old.Duration.Duration)
+		for i := range s.Regions {
+			s.Regions[i].Start.Duration = time.Duration(float64(s.Regions[i].Start.Duration) * scale)
+			s.Regions[i].End.Duration = time.Duration(float64(s.Regions[i].End.Duration) * scale)
+		}
+	case "invalidate":
+		if current.Duration == nil {
+			return fmt.Errorf("mashu.Source.RefreshMedia: unable to invalidate '%s': unknown current duration", s.Key)
+		}
+		s.Regions = []TaggedRegion{TaggedRegion{Region: Region{End: *current.Duration}}}
+	default:
+		return fmt.Errorf("mashu.Source.RefreshMedia: unknown mode '%s' (must be rescale or invalidate)", mode)
+	}
+
+	return
+}
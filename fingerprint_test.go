@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckMedia(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media.mkv")
+	if err := os.WriteFile(path, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := Source{Key: "a", Video: &Track{Path: Input(path)}}
+	if err := s.Fingerprint(); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := s.CheckMedia(); touched || err != nil {
+		t.Fatalf("CheckMedia of unchanged media = %v, %v", touched, err)
+	}
+
+	// a touched file is rehashed once, its new time kept
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if touched, err := s.CheckMedia(); !touched || err != nil {
+		t.Fatalf("CheckMedia of touched media = %v, %v", touched, err)
+	}
+	if !s.Media[Input(path)].ModTime.Equal(later) {
+		t.Errorf("fingerprint time %v, want %v", s.Media[Input(path)].ModTime, later)
+	}
+	if touched, err := s.CheckMedia(); touched || err != nil {
+		t.Fatalf("CheckMedia after refreshing = %v, %v", touched, err)
+	}
+
+	if err := os.WriteFile(path, []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CheckMedia(); !errors.Is(err, ErrMediaChanged) {
+		t.Errorf("CheckMedia of changed media = %v, want ErrMediaChanged", err)
+	}
+}
+
+func TestProjectCheckMedia(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "media.mkv")
+	if err := os.WriteFile(path, []byte("media"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := Source{Key: "a", Video: &Track{Path: Input(path)}}
+	if err := s.Fingerprint(); err != nil {
+		t.Fatal(err)
+	}
+
+	p := testProject(t, "{}", 0, 0)
+	if err := p.Catalog.Create(s); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	plans := map[string]Plan{"clip": {Name: "clip", Clip: &PlanClip{SrcKey: &s.Key, Region: span(0, 1)}}}
+	if err := p.checkMedia(plans); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := p.Catalog.Lookup(s.Key); !stored.Media[Input(path)].ModTime.Equal(later) {
+		t.Errorf("stored fingerprint time %v, want %v", stored.Media[Input(path)].ModTime, later)
+	}
+}
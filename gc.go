@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// inputs returns the names of the plans consumed by plan.
+func (plan Plan) inputs() (names []string) {
+	switch {
+	case plan.Blend != nil:
+		var keys []string
+		for k := range plan.Blend.Attachments {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			names = append(names, string(plan.Blend.Attachments[k]))
+		}
+	case plan.Concat != nil:
+		names = plan.Concat.Input
+	case plan.Stack != nil:
+		names = plan.Stack.Input
+	}
+	return
+}
+
+// reachablePlans returns the root plan and, by name, every plan reachable
+// from it, including the root itself.
+func (p Project) reachablePlans() (root Plan, reachable map[string]Plan, err error) {
+	if err = decodeJsonFromFile(filepath.Join(p.Path, "plan.json"), &root); err != nil {
+		err = fmt.Errorf("mashu.Project.reachablePlans: unable to load plan ('%s/plan.json'): %w", p.Path, err)
+		return
+	}
+
+	reachable, err = p.reachableFrom(root)
+	return
+}
+
+// reachableFrom returns, by name, root and every plan reachable from it.
+func (p Project) reachableFrom(root Plan) (reachable map[string]Plan, err error) {
+	reachable = map[string]Plan{root.Name: root}
+	pending := root.inputs()
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		if _, ok := reachable[name]; ok {
+			continue
+		}
+
+		var plan Plan
+		if plan, err = p.loadPlan(name); err != nil {
+			return
+		}
+		reachable[name] = plan
+		pending = append(pending, plan.inputs()...)
+	}
+
+	return
+}
+
+// GarbageFile is a plan or render file of no plan reachable from plan.json.
+type GarbageFile struct {
+	Path string
+	Size int64
+}
+
+// Garbage lists the files of the project's plan and render directories that
+// belong to no plan reachable from plan.json.
+func (p Project) Garbage() (files []GarbageFile, err error) {
+	var reachable map[string]Plan
+	if _, reachable, err = p.reachablePlans(); err != nil {
+		return
+	}
+
+	for _, dir := range []string{"plan", "render"} {
+		var entries []os.DirEntry
+		if entries, err = os.ReadDir(filepath.Join(p.Path, dir)); errors.Is(err, fs.ErrNotExist) {
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+
+		for _, e := range entries {
+			name := e.Name()
+			if _, ok := reachable[strings.TrimSuffix(name, filepath.Ext(name))]; e.IsDir() || ok {
+				continue
+			}
+
+			var fi fs.FileInfo
+			if fi, err = e.Info(); err != nil {
+				return
+			}
+			files = append(files, GarbageFile{filepath.Join(p.Path, dir, name), fi.Size()})
+		}
+	}
+
+	return
+}
+
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGarbage(t *testing.T) {
+	generator := `{"Target":"20s","Alignment":"1s","MaxConcat":3,"Segments":[{"Clip":{"Start":"2s","End":"4s"},"Tickets":1}]}`
+	p := testProject(t, generator, 3, time.Minute)
+
+	gen, err := p.Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gen.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Mkdir(filepath.Join(p.Path, "render"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]bool{
+		filepath.Join(p.Path, "plan", "unreachable.json"): true,
+		p.renderPath("unreachable"):                       true,
+	}
+	for _, path := range []string{filepath.Join(p.Path, "plan", "unreachable.json"), p.renderPath("unreachable"), p.renderPath(gen.Root)} {
+		if err = os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var files []GarbageFile
+	if files, err = p.Garbage(); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if !want[f.Path] {
+			t.Errorf("%s listed as garbage", f.Path)
+		}
+		delete(want, f.Path)
+	}
+	for path := range want {
+		t.Errorf("%s not listed as garbage", path)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Generation is a generated mashup, held in memory until it is committed to
+// its project.
+type Generation struct {
+	Root     string
+	Seed     int64
+	Target   Duration
+	Duration Duration
+
+	p         Project
+	h         *generatorHistory
+	r         *rand.Rand
+	plans     map[string]Plan
+	durations map[string]Duration
+	order     []string
+	pools     map[string]func(n int) ([]Source, error)
+}
+
+func newGeneration(p Project, seed int64) *Generation {
+	return &Generation{
+		Seed:      seed,
+		p:         p,
+		h:         newGeneratorHistory(),
+		r:         rand.New(rand.NewSource(seed)),
+		plans:     make(map[string]Plan),
+		durations: make(map[string]Duration),
+		pools:     make(map[string]func(n int) ([]Source, error)),
+	}
+}
+
+// pullSourceFunc returns the function pulling sources for g, shared by every
+// generator drawing from the same pool.
+func (gen *Generation) pullSourceFunc(g PlanGeneratorParameters) (fn func(n int) ([]Source, error), err error) {
+	if fn = gen.pools[g.pool()]; fn != nil {
+		return
+	}
+	if fn, err = g.PullSourceFunc(gen.p, gen.h, gen.r); err != nil {
+		return
+	}
+	gen.pools[g.pool()] = fn
+	return
+}
+
+// add stores plan, lasting d, under a random name starting with prefix that
+// is used neither by the generation nor in the project's plan directory.
+func (gen *Generation) add(prefix string, d Duration, plan Plan) (name string, err error) {
+	for {
+		b := make([]byte, 16)
+		if _, err = crand.Read(b); err != nil {
+			return
+		}
+		name = fmt.Sprintf("%s-%x", prefix, b)
+		if _, ok := gen.plans[name]; ok {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(gen.p.Path, "plan", name+".json")); err == nil {
+			continue
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		err = nil
+
+		plan.Name = name
+		gen.plans[name] = plan
+		gen.durations[name] = d
+		gen.order = append(gen.order, name)
+		return
+	}
+}
+
+// Print writes the generation's plan tree, with the duration of every plan.
+func (gen *Generation) Print(w io.Writer) (err error) {
+	if err = gen.print(w, gen.Root, 0); err != nil {
+		return
+	}
+	_, err = fmt.Fprintf(w, "estimated duration %s\n", gen)
+	return
+}
+
+// String reports the duration of the generation against the requested one.
+func (gen *Generation) String() string {
+	if gen.Target.Duration == 0 {
+		return fmt.Sprintf("%s (seed %d)", gen.Duration, gen.Seed)
+	}
+	return fmt.Sprintf("%s of %s requested (seed %d)", gen.Duration, gen.Target, gen.Seed)
+}
+
+func (gen *Generation) print(w io.Writer, name string, depth int) (err error) {
+	plan := gen.plans[name]
+	line := fmt.Sprintf("%s%s %s", strings.Repeat("  ", depth), name, gen.durations[name])
+
+	if plan.Clip != nil {
+		line += fmt.Sprintf(" %s [%s-%s]", *plan.Clip.SrcKey, plan.Clip.Region.Start, plan.Clip.Region.End)
+	} else if plan.Blend != nil {
+		line += " " + plan.Blend.Name
+	}
+
+	if _, err = fmt.Fprintln(w, line); err != nil {
+		return
+	}
+	for _, child := range plan.inputs() {
+		if err = gen.print(w, child, depth+1); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// committed returns, in creation order, the plans reachable from the root;
+// plans of a segment abandoned when the sources ran out are left out.
+func (gen *Generation) committed() (names []string) {
+	reachable := map[string]bool{gen.Root: true}
+	pending := []string{gen.Root}
+	for len(pending) > 0 {
+		for _, name := range gen.plans[pending[0]].inputs() {
+			if !reachable[name] {
+				reachable[name] = true
+				pending = append(pending, name)
+			}
+		}
+		pending = pending[1:]
+	}
+
+	for _, name := range gen.order {
+		if reachable[name] {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// Commit writes the generation's plans to a staging directory, moves them into
+// the project's plan directory and then replaces the plan.json and output
+// symlinks, so a failed commit leaves the previous generation current. A
+// project that was already generated is only replaced with force.
+func (gen *Generation) Commit(force bool) (err error) {
+	p := gen.p
+	format := strings.ToLower(p.Format.Format)
+	links := [][2]string{
+		{"plan.json", filepath.Join("plan", gen.Root+".json")},
+		{"output." + format, filepath.Join("render", gen.Root+"."+format)},
+	}
+
+	if !force {
+		for _, link := range links {
+			if _, err = os.Lstat(filepath.Join(p.Path, link[0])); err == nil {
+				return fmt.Errorf("mashu.Generation.Commit: project '%s' already generated ('%s' exists; use -force to replace it): %w",
+					p.Path, link[0], fs.ErrExist)
+			}
+		}
+		err = nil
+	}
+
+	names := gen.committed()
+
+	var staging string
+	if staging, err = os.MkdirTemp(p.Path, ".generate-"); err != nil {
+		return
+	}
+	defer os.RemoveAll(staging)
+
+	for _, name := range names {
+		if err = encodeJsonToFile(filepath.Join(staging, name+".json"), gen.plans[name]); err != nil {
+			return
+		}
+	}
+	for _, link := range links {
+		if err = os.Symlink(link[1], filepath.Join(staging, link[0])); err != nil {
+			return
+		}
+	}
+
+	for _, name := range names {
+		if err = os.Rename(filepath.Join(staging, name+".json"), filepath.Join(p.Path, "plan", name+".json")); err != nil {
+			return
+		}
+	}
+	for _, link := range links {
+		if err = os.Rename(filepath.Join(staging, link[0]), filepath.Join(p.Path, link[0])); err != nil {
+			return
+		}
+	}
+
+	return
+}
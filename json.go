@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"io/fs"
 	"os"
+	"path/filepath"
 )
 
 func decodeJsonFromFile(path string, o ...any) (err error) {
@@ -21,3 +23,33 @@ func decodeJsonFromFile(path string, o ...any) (err error) {
 
 	return f.Close()
 }
+
+func encodeJsonToFile(path string, o ...any) (err error) {
+	var f *os.File
+	if f, err = os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// keep the mode of the file replaced, the temporary file being private
+	mode := fs.FileMode(0644)
+	if fi, serr := os.Stat(path); serr == nil {
+		mode = fi.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		return
+	}
+
+	e := json.NewEncoder(f)
+	for _, x := range o {
+		if err = e.Encode(x); err != nil {
+			return
+		}
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+
+	return os.Rename(f.Name(), path)
+}
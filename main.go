@@ -1,21 +1,54 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	catalogPath = flag.String("catalog-path", "/var/mashu/catalog", "source catalog")
-	catalogAlgo = flag.String("catalog-algorithm", "SHA-512", "source catalog algorithm")
-	catalogMode = flag.Bool("catalog", false, "catalog inputs")
-	planMode    = flag.Bool("plan", false, "execute specified plans")
-	genMode     = flag.Bool("generate", false, "generate a plans for the specified projects")
+	catalogPath    = flag.String("catalog-path", "/var/mashu/catalog", "source catalog")
+	catalogAlgo    = flag.String("catalog-algorithm", "SHA-512", "source catalog algorithm")
+	catalogBackend = flag.String("catalog-backend", "", "source catalog backend (fsmap or jsonl; defaults to fsmap when available)")
+	catalogMode    = flag.Bool("catalog", false, "catalog inputs")
+	batchMode      = flag.Bool("batch", false, "catalog inputs without interactive editing (with -catalog)")
+	batchRules     = flag.String("batch-rules", "", "rules file applied when batch cataloging")
+	chapterRules   = flag.String("chapter-rules", "", "rules file mapping chapter titles to tags when cataloging")
+	proposeMode    = flag.Bool("propose", false, "propose scene, black and quiet regions when cataloging")
+	sceneThreshold = flag.Float64("scene-threshold", DefaultDetectOptions.SceneThreshold, "scene change score (0-100) starting a new scene (with -propose)")
+	sceneMinimum   = flag.Duration("scene-minimum", DefaultDetectOptions.SceneMinimum, "minimum length of a proposed scene (with -propose)")
+	blackMinimum   = flag.Duration("black-minimum", DefaultDetectOptions.BlackMinimum, "minimum length of a proposed black region (with -propose)")
+	silenceNoise   = flag.String("silence-noise", DefaultDetectOptions.SilenceNoise, "audio level treated as silence (with -propose)")
+	silenceMinimum = flag.Duration("silence-minimum", DefaultDetectOptions.SilenceMinimum, "minimum length of a proposed quiet region (with -propose)")
+	reviewMode     = flag.Bool("review", false, "interactively review batch cataloged sources (with -catalog)")
+	checkMode      = flag.Bool("catalog-check", false, "check cataloged sources for changed media")
+	checkFix       = flag.String("catalog-check-fix", "", "refresh changed sources (rescale or invalidate their regions)")
+	planMode       = flag.Bool("plan", false, "execute specified plans")
+	genMode        = flag.Bool("generate", false, "generate a plans for the specified projects")
+	seed           = flag.String("seed", "", "seed for -generate (overrides generator.json)")
+	dryRun         = flag.Bool("dry-run", false, "print the generated plan tree without writing it (with -generate)")
+	extend         = flag.Duration("extend", 0, "append this much to each project's current generation (with -generate)")
+	force          = flag.Bool("force", false, "replace a previous generation (with -generate)")
+	recurringMode  = flag.Bool("recurring", false, "tag intros and outros shared by the specified sources (m3u files or key prefixes)")
+	recurringWin   = flag.Duration("recurring-window", 5*time.Minute, "length of the start and end searched for intros and outros")
+	recurringMin   = flag.Duration("recurring-minimum", 20*time.Second, "minimum length of a recurring intro or outro")
+	importMode     = flag.Bool("import-markers", false, "merge regions from marker files (after the source key) into a cataloged source; single marks, such as mpv watch-later positions, pair up across the files")
+	markersFormat  = flag.String("markers-format", "", "marker file format (audacity, csv or mpv; guessed from the extension by default)")
+	markersTags    = flag.String("markers-tags", "", "comma separated tags added to every imported region")
+	tagsMode       = flag.Bool("tags", false, "edit tags across the catalog (rename FROM TO, merge FROM... TO, delete TAG...)")
+	queryMode      = flag.Bool("query", false, "list sources matching the specified tag expression (e.g. '(fight OR chase) AND NOT spoiler'), or every tag with its total duration when none is given")
+	pruneMode      = flag.Bool("prune", false, "delete intermediate renders once consumed, keeping the root and pinned plans, and print the estimated peak disk use (when rendering projects)")
+	gcMode         = flag.Bool("gc", false, "list plans and renders unreachable from plan.json in the specified projects")
+	gcDelete       = flag.Bool("gc-delete", false, "delete the unreachable plans and renders (with -gc)")
 )
 
 func catalogMain(c Catalog, args []string) (err error) {
@@ -36,17 +69,118 @@ func catalogMain(c Catalog, args []string) (err error) {
 		return
 	}
 
+	o := CatalogOptions{
+		Propose: *proposeMode,
+		Detect: DetectOptions{
+			SceneThreshold: *sceneThreshold,
+			SceneMinimum:   *sceneMinimum,
+			BlackMinimum:   *blackMinimum,
+			SilenceNoise:   *silenceNoise,
+			SilenceMinimum: *silenceMinimum,
+		},
+	}
+	if o.ChapterRules, err = loadChapterRules(*chapterRules); err != nil {
+		return
+	}
+
 	var sources []Source
-	if sources, err = buildSources(targets...); err != nil {
+	if *batchMode {
+		if o.BatchRules, err = loadBatchRules(*batchRules); err != nil {
+			return
+		}
+		sources = batchSources(o, targets...)
+	} else if sources, err = buildSources(o, targets...); err != nil {
 		return fmt.Errorf("mashu: error building sources: %w", err)
 	}
-	for i, s := range sources {
-		if err = c.Create(s); err != nil {
-			return fmt.Errorf("mashu: error cataloging source for '%s': %w", targets[i], err)
+
+	return catalogBatch(c, func(b Catalog) error {
+		for _, s := range sources {
+			if err := b.Create(s); err != nil {
+				return fmt.Errorf("mashu: error cataloging source for '%s': %w", s.Key, err)
+			}
 		}
+		return nil
+	})
+}
+
+func reviewMain(c Catalog, args []string) (err error) {
+	keys := args
+	if len(keys) == 0 {
+		if keys, err = c.Keys(context.TODO()); err != nil {
+			return
+		}
+		sort.Strings(keys)
 	}
 
-	return
+	var drafts []Source
+	for _, key := range keys {
+		var s Source
+		if s, err = c.Lookup(key); err != nil {
+			return
+		}
+		if !s.Unreviewed {
+			continue
+		}
+		s.Unreviewed = false
+		drafts = append(drafts, s)
+	}
+
+	var sources []Source
+	if sources, err = editSources(drafts); err != nil {
+		return fmt.Errorf("mashu: error reviewing sources: %w", err)
+	}
+
+	return catalogBatch(c, func(b Catalog) error {
+		for _, s := range sources {
+			if err := b.Update(s); err != nil {
+				return fmt.Errorf("mashu: error updating source for '%s': %w", s.Key, err)
+			}
+		}
+		return nil
+	})
+}
+
+func checkMain(c Catalog, fix string) (err error) {
+	var keys []string
+	if keys, err = c.Keys(context.TODO()); err != nil {
+		return
+	}
+	sort.Strings(keys)
+
+	var refreshed []Source
+	for _, key := range keys {
+		var s Source
+		if s, err = c.Lookup(key); err != nil {
+			return
+		}
+
+		var touched bool
+		if touched, err = s.CheckMedia(); touched {
+			refreshed = append(refreshed, s)
+		}
+		if err == nil {
+			continue
+		}
+		fmt.Printf("%s\t%v\n", key, err)
+		if !errors.Is(err, ErrMediaChanged) || fix == "" {
+			err = nil
+			continue
+		}
+
+		if err = s.RefreshMedia(fix); err != nil {
+			return
+		}
+		refreshed = append(refreshed, s)
+	}
+
+	return catalogBatch(c, func(b Catalog) error {
+		for _, s := range refreshed {
+			if err := b.Update(s); err != nil {
+				return fmt.Errorf("mashu: error updating source for '%s': %w", s.Key, err)
+			}
+		}
+		return nil
+	})
 }
 
 func planMain(c Catalog, args []string) error {
@@ -57,7 +191,7 @@ func planMain(c Catalog, args []string) error {
 			return err
 		}
 
-		if err := project.executePlanByName(strings.TrimSuffix(filepath.Base(arg), ".json")); err != nil {
+		if err := project.ExecutePlan(strings.TrimSuffix(filepath.Base(arg), ".json")); err != nil {
 			return err
 		}
 	}
@@ -66,13 +200,40 @@ func planMain(c Catalog, args []string) error {
 }
 
 func genMain(c Catalog, args []string) error {
+	var genSeed *int64
+	if *seed != "" {
+		s, err := strconv.ParseInt(*seed, 10, 64)
+		if err != nil {
+			return fmt.Errorf("mashu: invalid seed '%s': %w", *seed, err)
+		}
+		genSeed = &s
+	}
+
+	if *dryRun {
+		c = memoryIndexCatalog{c}
+	}
+
 	for _, arg := range args {
 		project, err := NewProject(arg, c)
 		if err != nil {
 			return err
 		}
 
-		if err := project.Generate(); err != nil {
+		var gen *Generation
+		if *extend > 0 {
+			gen, err = project.Extend(Duration{*extend}, genSeed)
+		} else {
+			gen, err = project.Generate(genSeed)
+		}
+		if err != nil {
+			return err
+		}
+		if *dryRun {
+			err = gen.Print(os.Stdout)
+		} else if err = gen.Commit(*force || *extend > 0); err == nil {
+			fmt.Printf("%s: generated %s\n", arg, gen)
+		}
+		if err != nil {
 			return err
 		}
 	}
@@ -80,6 +241,146 @@ func genMain(c Catalog, args []string) error {
 	return nil
 }
 
+func queryMain(c Catalog, args []string) (err error) {
+	var g PlanGeneratorParameters
+	if g.Tags, err = ParseTagExpr(strings.Join(args, " ")); err != nil {
+		return
+	}
+
+	var idx *CatalogIndex
+	if ic, ok := c.(indexedCatalog); ok {
+		idx, err = ic.Index(context.TODO())
+	} else {
+		idx, err = buildCatalogIndex(context.TODO(), c)
+	}
+	if err != nil {
+		return fmt.Errorf("mashu: error loading catalog index: %w", err)
+	}
+
+	// without an expression, summarize every tag instead
+	if len(args) == 0 {
+		tags := make([]string, 0, len(idx.Tags))
+		for tag := range idx.Tags {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for _, tag := range tags {
+			e := idx.Tags[tag]
+			fmt.Printf("%s\t%d regions\t%v\n", tag, len(e.Regions), e.Duration)
+		}
+		return
+	}
+
+	keys, durations := idx.Match(g)
+	for _, key := range keys {
+		fmt.Printf("%s\t%v\n", key, durations[key])
+	}
+
+	return
+}
+
+func recurringMain(c Catalog, args []string) (err error) {
+	var keys []string
+	if keys, err = recurringKeys(c, args); err != nil {
+		return
+	}
+
+	return TagRecurring(context.TODO(), c, keys, Duration{*recurringWin}, Duration{*recurringMin})
+}
+
+func importMain(c Catalog, args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("mashu: -import-markers needs a source key and at least one marker file")
+	}
+
+	var s Source
+	if s, err = c.Lookup(args[0]); err != nil {
+		return
+	}
+
+	// point marks may pair with those of another file (such as two mpv
+	// watch-later files saved at the start and end of a scene)
+	var regions []TaggedRegion
+	for _, path := range args[1:] {
+		var r []TaggedRegion
+		if r, err = ReadMarkers(path, *markersFormat); err != nil {
+			return
+		}
+		regions = append(regions, r...)
+	}
+	regions = pairPoints(regions)
+	for i := range regions {
+		regions[i].Tags = append(regions[i].Tags, splitTags(*markersTags)...)
+	}
+	s.Regions = MergeRegions(s.Regions, regions)
+
+	if err = c.Update(s); err != nil {
+		return fmt.Errorf("mashu: error updating source for '%s': %w", s.Key, err)
+	}
+
+	return
+}
+
+func tagsMain(c Catalog, args []string) (err error) {
+	if len(args) < 2 {
+		return fmt.Errorf("mashu: -tags needs a command (rename, merge or delete) and tags")
+	}
+
+	var n int
+	switch args[0] {
+	case "rename":
+		if len(args) != 3 {
+			return fmt.Errorf("mashu: -tags rename needs exactly one tag to rename and a new name")
+		}
+		n, err = RenameTags(context.TODO(), c, args[2], args[1])
+	case "merge":
+		if len(args) < 3 {
+			return fmt.Errorf("mashu: -tags merge needs tags to merge and a target tag")
+		}
+		n, err = RenameTags(context.TODO(), c, args[len(args)-1], args[1:len(args)-1]...)
+	case "delete":
+		n, err = DeleteTags(context.TODO(), c, args[1:]...)
+	default:
+		return fmt.Errorf("mashu: unknown -tags command '%s' (must be rename, merge or delete)", args[0])
+	}
+
+	log.Printf("mashu: updated %d sources", n)
+	return
+}
+
+func gcMain(c Catalog, args []string) error {
+	for _, arg := range args {
+		project, err := NewProject(arg, c)
+		if err != nil {
+			return err
+		}
+
+		files, err := project.Garbage()
+		if err != nil {
+			return err
+		}
+
+		var size int64
+		for _, f := range files {
+			fmt.Printf("%s\t%s\n", formatSize(f.Size), f.Path)
+			size += f.Size
+			if *gcDelete {
+				if err := os.Remove(f.Path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if *gcDelete {
+			fmt.Printf("%s: deleted %d files (%s)\n", arg, len(files), formatSize(size))
+		} else {
+			fmt.Printf("%s: %d unreachable files (%s); delete them with -gc-delete\n", arg, len(files), formatSize(size))
+		}
+	}
+
+	return nil
+}
+
 func projectMain(c Catalog, args []string) error {
 	for _, arg := range args {
 		project, err := NewProject(arg, c)
@@ -87,7 +388,15 @@ func projectMain(c Catalog, args []string) error {
 			return err
 		}
 
-		if err := project.Execute(); err != nil {
+		if *pruneMode {
+			peak, err := project.EstimatePeakDisk(true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: estimated peak disk use %s\n", arg, formatSize(peak))
+		}
+
+		if err := project.Execute(*pruneMode); err != nil {
 			return err
 		}
 	}
@@ -98,34 +407,87 @@ func projectMain(c Catalog, args []string) error {
 func main() {
 	flag.Parse()
 
-	catalog, err := NewCatalog(*catalogPath, *catalogAlgo)
+	if *reviewMode && !*catalogMode {
+		log.Fatal("mashu: -review needs -catalog")
+	}
+
+	catalog, err := NewCatalog(*catalogBackend, *catalogPath, *catalogAlgo)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
 
+	if *catalogMode && *reviewMode {
+		if err := reviewMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *catalogMode {
-		if err := catalogMain(*catalog, flag.Args()); err != nil {
+		if err := catalogMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *checkMode {
+		if err := checkMain(catalog, *checkFix); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
 	if *planMode {
-		if err := planMain(*catalog, flag.Args()); err != nil {
+		if err := planMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *recurringMode {
+		if err := recurringMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *importMode {
+		if err := importMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *tagsMode {
+		if err := tagsMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *queryMode {
+		if err := queryMain(catalog, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *gcMode {
+		if err := gcMain(catalog, flag.Args()); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
 	if *genMode {
-		if err := genMain(*catalog, flag.Args()); err != nil {
+		if err := genMain(catalog, flag.Args()); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
 
-	if err := projectMain(*catalog, flag.Args()); err != nil {
+	if err := projectMain(catalog, flag.Args()); err != nil {
 		log.Fatal(err)
 		return
 	}
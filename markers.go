@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp accepts seconds ("93.5"), clock times ("1:33.5",
+// "0:01:33.5") and Go durations ("1m33.5s").
+func parseTimestamp(s string) (d Duration, err error) {
+	s = strings.TrimSpace(s)
+	if f, ferr := strconv.ParseFloat(s, 64); ferr == nil {
+		return Duration{time.Duration(f * float64(time.Second))}, nil
+	}
+	if strings.Contains(s, ":") {
+		var total float64
+		for _, part := range strings.Split(s, ":") {
+			var f float64
+			if f, err = strconv.ParseFloat(part, 64); err != nil {
+				err = fmt.Errorf("mashu.parseTimestamp: bad timestamp '%s': %w", s, err)
+				return
+			}
+			total = total*60 + f
+		}
+		return Duration{time.Duration(total * float64(time.Second))}, nil
+	}
+	if d.Duration, err = time.ParseDuration(s); err != nil {
+		err = fmt.Errorf("mashu.parseTimestamp: bad timestamp '%s': %w", s, err)
+	}
+	return
+}
+
+func splitTags(s string) (tags []string) {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ',' || r == ';' || r == '\t'
+	})
+}
+
+// parseAudacityLabels reads an Audacity label track export: tab separated
+// start, end and label, with the label's words used as tags.
+func parseAudacityLabels(r io.Reader) (regions []TaggedRegion, err error) {
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		// frequency ranges of spectral labels are continuation lines
+		if len(strings.TrimSpace(l)) == 0 || strings.HasPrefix(l, "\\") {
+			continue
+		}
+
+		fields := strings.SplitN(l, "\t", 3)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("mashu.parseAudacityLabels: bad label line '%s'", l)
+		}
+
+		var t TaggedRegion
+		if t.Start, err = parseTimestamp(fields[0]); err != nil {
+			return
+		}
+		if t.End, err = parseTimestamp(fields[1]); err != nil {
+			return
+		}
+		if len(fields) == 3 {
+			t.Tags = splitTags(fields[2])
+		}
+		regions = append(regions, t)
+	}
+
+	err = s.Err()
+	return
+}
+
+// parseCsvMarkers reads start,end,tags records; a header row is skipped.
+func parseCsvMarkers(r io.Reader) (regions []TaggedRegion, err error) {
+	c := csv.NewReader(r)
+	c.FieldsPerRecord = -1
+	c.TrimLeadingSpace = true
+
+	for line := 1; ; line++ {
+		var record []string
+		if record, err = c.Read(); err == io.EOF {
+			return regions, nil
+		} else if err != nil {
+			return
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("mashu.parseCsvMarkers: line %d: need at least start and end", line)
+		}
+
+		var t TaggedRegion
+		if t.Start, err = parseTimestamp(record[0]); err != nil {
+			if line == 1 {
+				err = nil
+				continue
+			}
+			return
+		}
+		if t.End, err = parseTimestamp(record[1]); err != nil {
+			return
+		}
+		for _, field := range record[2:] {
+			t.Tags = append(t.Tags, splitTags(field)...)
+		}
+		regions = append(regions, t)
+	}
+}
+
+// parseMpvMarkers reads mpv watch-later files (start=<seconds>) and bookmark
+// lists (one timestamp per line, optionally followed by tags). The marks of
+// a bookmark list are sorted and paired in order, each pair forming one
+// region. The single position of a watch-later file is returned as a point
+// region, left to be paired with the marks of other files.
+func parseMpvMarkers(r io.Reader) (regions []TaggedRegion, err error) {
+	type mark struct {
+		At   Duration
+		Tags []string
+	}
+	var marks []mark
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if len(l) == 0 || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(l, "start=") {
+			var at Duration
+			if at, err = parseTimestamp(strings.TrimPrefix(l, "start=")); err != nil {
+				return
+			}
+			regions = append(regions, TaggedRegion{Region: Region{at, at}})
+			continue
+		}
+		if strings.Contains(l, "=") {
+			// other watch-later options
+			continue
+		}
+
+		fields := strings.Fields(l)
+		var m mark
+		if m.At, err = parseTimestamp(fields[0]); err != nil {
+			return
+		}
+		m.Tags = fields[1:]
+		marks = append(marks, m)
+	}
+	if err = s.Err(); err != nil {
+		return
+	}
+
+	if len(marks)%2 != 0 {
+		return nil, fmt.Errorf("mashu.parseMpvMarkers: odd number of marks (%d) cannot be paired into regions", len(marks))
+	}
+
+	sort.SliceStable(marks, func(i, j int) bool { return marks[i].At.Duration < marks[j].At.Duration })
+	for i := 0; i < len(marks); i += 2 {
+		regions = append(regions, TaggedRegion{
+			Region: Region{marks[i].At, marks[i+1].At},
+			Tags:   append(marks[i].Tags, marks[i+1].Tags...),
+		})
+	}
+
+	return
+}
+
+// ReadMarkers reads regions from a marker file. An empty format is guessed
+// from the extension: .txt is an Audacity label track, .csv is csv and
+// anything else is read as mpv marks.
+func ReadMarkers(path, format string) (regions []TaggedRegion, err error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".txt":
+			format = "audacity"
+		case ".csv":
+			format = "csv"
+		default:
+			format = "mpv"
+		}
+	}
+
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	switch format {
+	case "audacity":
+		regions, err = parseAudacityLabels(f)
+	case "csv":
+		regions, err = parseCsvMarkers(f)
+	case "mpv":
+		regions, err = parseMpvMarkers(f)
+	default:
+		err = fmt.Errorf("mashu.ReadMarkers: unknown marker format '%s' (must be audacity, csv or mpv)", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mashu.ReadMarkers: reading '%s': %w", path, err)
+	}
+
+	for _, r := range regions {
+		if r.Start == r.End {
+			continue
+		}
+		if err = r.Valid(); err != nil {
+			return nil, fmt.Errorf("mashu.ReadMarkers: reading '%s': %w", path, err)
+		}
+	}
+
+	return
+}
+
+// pairPoints replaces the point regions (marks with no length, such as mpv
+// watch-later positions and Audacity point labels) among regions, which may
+// have been read from several files, by regions joining them in pairs in
+// time order. A point left without a pair is dropped.
+func pairPoints(regions []TaggedRegion) (paired []TaggedRegion) {
+	var points []TaggedRegion
+	for _, r := range regions {
+		if r.Start == r.End {
+			points = append(points, r)
+		} else {
+			paired = append(paired, r)
+		}
+	}
+
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Start.Duration < points[j].Start.Duration })
+	for i := 0; i+1 < len(points); i += 2 {
+		if points[i].Start == points[i+1].Start {
+			log.Printf("mashu.pairPoints: skipping marks at %v and %v: a region needs two distinct marks", points[i].Start, points[i+1].Start)
+			continue
+		}
+		paired = append(paired, TaggedRegion{
+			Region: Region{points[i].Start, points[i+1].Start},
+			Tags:   append(append([]string(nil), points[i].Tags...), points[i+1].Tags...),
+		})
+	}
+	if len(points)%2 != 0 {
+		log.Printf("mashu.pairPoints: skipping the mark at %v: no mark left to pair it with", points[len(points)-1].Start)
+	}
+
+	return
+}
+
+func sameTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string(nil), a...)
+	bs := append([]string(nil), b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func overlaps(a, b Region) bool {
+	return a.Start.Duration <= b.End.Duration && b.Start.Duration <= a.End.Duration
+}
+
+// mergeTarget returns the index of a region of merged other than i that has
+// the tags of merged[i] and overlaps it, or -1. Untagged regions, such as
+// the full length of a source, are never merged.
+func mergeTarget(merged []TaggedRegion, i int) int {
+	if len(merged[i].Tags) == 0 {
+		return -1
+	}
+	for j, m := range merged {
+		if j != i && sameTags(m.Tags, merged[i].Tags) && overlaps(m.Region, merged[i].Region) {
+			return j
+		}
+	}
+	return -1
+}
+
+// MergeRegions adds regions to existing ones. Exact duplicates, tagged or
+// not, are dropped. A tagged region that overlaps one with the same tags is
+// merged into it, extending it to cover both, and a region so extended is
+// merged in turn with those it now overlaps; other regions are appended.
+func MergeRegions(existing, regions []TaggedRegion) []TaggedRegion {
+	merged := append([]TaggedRegion(nil), existing...)
+
+region:
+	for _, r := range regions {
+		for _, m := range merged {
+			if m.Region == r.Region && sameTags(m.Tags, r.Tags) {
+				continue region
+			}
+		}
+
+		merged = append(merged, r)
+		i := len(merged) - 1
+		for j := mergeTarget(merged, i); j >= 0; j = mergeTarget(merged, i) {
+			if merged[i].Start.Duration < merged[j].Start.Duration {
+				merged[j].Start = merged[i].Start
+			}
+			if merged[i].End.Duration > merged[j].End.Duration {
+				merged[j].End = merged[i].End
+			}
+			merged = append(merged[:i], merged[i+1:]...)
+			if j > i {
+				j--
+			}
+			i = j
+		}
+	}
+
+	return merged
+}
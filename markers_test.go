@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func tagged(start, end int, tags ...string) TaggedRegion {
+	return TaggedRegion{Region: span(start, end), Tags: tags}
+}
+
+func TestMergeRegions(t *testing.T) {
+	tests := []struct {
+		name              string
+		existing, regions []TaggedRegion
+		merged            []TaggedRegion
+	}{
+		{
+			"untagged kept apart",
+			[]TaggedRegion{tagged(0, 1000)},
+			[]TaggedRegion{tagged(10, 20)},
+			[]TaggedRegion{tagged(0, 1000), tagged(10, 20)},
+		},
+		{
+			"untagged duplicate",
+			[]TaggedRegion{tagged(0, 1000), tagged(10, 20)},
+			[]TaggedRegion{tagged(10, 20), tagged(0, 1000)},
+			[]TaggedRegion{tagged(0, 1000), tagged(10, 20)},
+		},
+		{
+			"duplicate",
+			[]TaggedRegion{tagged(0, 1000), tagged(10, 20, "op")},
+			[]TaggedRegion{tagged(10, 20, "op")},
+			[]TaggedRegion{tagged(0, 1000), tagged(10, 20, "op")},
+		},
+		{
+			"overlap extends",
+			[]TaggedRegion{tagged(10, 20, "op", "song")},
+			[]TaggedRegion{tagged(15, 30, "song", "op")},
+			[]TaggedRegion{tagged(10, 30, "op", "song")},
+		},
+		{
+			"other tags appended",
+			[]TaggedRegion{tagged(10, 20, "op")},
+			[]TaggedRegion{tagged(15, 30, "ed")},
+			[]TaggedRegion{tagged(10, 20, "op"), tagged(15, 30, "ed")},
+		},
+		{
+			"extended regions merged",
+			nil,
+			[]TaggedRegion{tagged(0, 10, "a"), tagged(20, 30, "a"), tagged(40, 50, "b"), tagged(5, 25, "a")},
+			[]TaggedRegion{tagged(0, 30, "a"), tagged(40, 50, "b")},
+		},
+	}
+
+	for _, test := range tests {
+		if merged := MergeRegions(test.existing, test.regions); !reflect.DeepEqual(merged, test.merged) {
+			t.Errorf("%s: MergeRegions = %v, want %v", test.name, merged, test.merged)
+		}
+	}
+}
+
+func TestReadMarkersPoints(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"start":      "# mpv watch later\nstart=10.000000\nvolume=80\n",
+		"end":        "start=25.5\n",
+		"labels.txt": "30\t30\tpunch\n40\t50\top\n60\t60\tkick\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var regions []TaggedRegion
+	for _, name := range []string{"start", "end", "labels.txt"} {
+		r, err := ReadMarkers(filepath.Join(dir, name), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		regions = append(regions, r...)
+	}
+
+	want := []TaggedRegion{
+		tagged(40, 50, "op"),
+		{Region: Region{seconds(10), Duration{25500 * time.Millisecond}}},
+		tagged(30, 60, "punch", "kick"),
+	}
+	if paired := pairPoints(regions); !reflect.DeepEqual(paired, want) {
+		t.Errorf("paired marks = %v, want %v", paired, want)
+	}
+
+	// a lone mark is dropped
+	if paired := pairPoints(regions[:1]); len(paired) != 0 {
+		t.Errorf("paired lone mark = %v, want none", paired)
+	}
+}
@@ -2,14 +2,14 @@ package main
 
 import (
 	"context"
-	crand "crypto/rand"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"math/rand"
-	"os"
+	"path"
 	"path/filepath"
-	"strings"
+	"sort"
+	"strconv"
 	"time"
 )
 
@@ -18,9 +18,22 @@ type PlanSegment struct {
 	Stack *struct {
 		Count    uint
 		Duration Region
+		// generate each cell as a sequence filling the stack's duration
+		// rather than as a single clip; it must specify its own segments
+		Cells *PlanGeneratorParameters `json:",omitempty"`
 	} `json:",omitempty"`
-	Blend   *string `json:",omitempty"`
-	Tickets uint
+	Blend *string `json:",omitempty"`
+	// a sub-sequence, such as a montage of short cuts, generated with its own
+	// parameters and segments; parameters it leaves unset are taken from the
+	// enclosing ones
+	Sequence *PlanGeneratorParameters `json:",omitempty"`
+	Tickets  uint
+	// tag filters and key restriction replacing the generator's for the
+	// sources of this segment
+	RequiredTags   []string `json:",omitempty"`
+	DisallowedTags []string `json:",omitempty"`
+	Tags           *TagExpr `json:",omitempty"`
+	Keys           []string `json:",omitempty"`
 }
 
 type PlanGeneratorParameters struct {
@@ -29,10 +42,321 @@ type PlanGeneratorParameters struct {
 	MaxConcat      uint
 	RequiredTags   []string
 	DisallowedTags []string
-	Segments       []PlanSegment
+	Tags           *TagExpr `json:",omitempty"`
+	// restrict sources to these keys or key globs
+	Keys []string `json:",omitempty"`
+	// how sources and regions are picked: uniform (the default), weight or
+	// duration (of the usable time in each)
+	Sampling string `json:",omitempty"`
+	// end exactly on Target (to Alignment) by shortening the final segment,
+	// preferring segments that fit and trimming the output otherwise
+	ExactTarget bool `json:",omitempty"`
+	// how sources are ordered: random (the default); ordered, taking every
+	// source once in the order of OrderBy with its regions in time order;
+	// or coverage, taking ClipsPerSource clips of every source in random
+	// order. A source the constraints block is passed over until usable.
+	// Ordered and coverage generations end once every source has
+	// contributed, or the constraints block every source left, or at
+	// Target when it is set and reached first.
+	Mode           string `json:",omitempty"`
+	OrderBy        string `json:",omitempty"` // key (the default) or a metadata field
+	ClipsPerSource uint   `json:",omitempty"`
+	// seed of the generation; a random one is used when unset
+	Seed *int64 `json:",omitempty"`
+	// ordered sections generated one after the other, each with its own
+	// Target; their unset parameters are taken from the enclosing ones
+	Sections []PlanGeneratorParameters `json:",omitempty"`
+	// clips that must separate two clips of the same source
+	RepeatGap uint `json:",omitempty"`
+	// never reuse time already used from a source
+	NoRegionOverlap bool `json:",omitempty"`
+	// consecutive segments that may share a tag; 0 means no limit
+	MaxTagRun uint `json:",omitempty"`
+	// never use a source twice in the same stack or blend
+	UniqueStackSources bool `json:",omitempty"`
+	Segments           []PlanSegment
+
+	// nesting of the sequence or stack cell generated with these parameters
+	depth uint
+	// number of the section generated with these parameters, from 1
+	sectionNumber int
+}
+
+// section returns the parameters of section s, taking those it leaves unset
+// from g.
+func (g PlanGeneratorParameters) section(s PlanGeneratorParameters) PlanGeneratorParameters {
+	if s.Alignment.Duration == 0 {
+		s.Alignment = g.Alignment
+	}
+	if s.MaxConcat == 0 {
+		s.MaxConcat = g.MaxConcat
+	}
+	if s.RequiredTags == nil {
+		s.RequiredTags = g.RequiredTags
+	}
+	if s.DisallowedTags == nil {
+		s.DisallowedTags = g.DisallowedTags
+	}
+	if s.Tags == nil {
+		s.Tags = g.Tags
+	}
+	if s.Keys == nil {
+		s.Keys = g.Keys
+	}
+	if s.Mode == "" {
+		s.Mode = g.Mode
+	}
+	if s.OrderBy == "" {
+		s.OrderBy = g.OrderBy
+	}
+	if s.ClipsPerSource == 0 {
+		s.ClipsPerSource = g.ClipsPerSource
+	}
+	if s.Sampling == "" {
+		s.Sampling = g.Sampling
+	}
+	if s.RepeatGap == 0 {
+		s.RepeatGap = g.RepeatGap
+	}
+	if s.MaxTagRun == 0 {
+		s.MaxTagRun = g.MaxTagRun
+	}
+	if s.Segments == nil {
+		s.Segments = g.Segments
+	}
+	s.NoRegionOverlap = s.NoRegionOverlap || g.NoRegionOverlap
+	s.UniqueStackSources = s.UniqueStackSources || g.UniqueStackSources
+	s.ExactTarget = s.ExactTarget || g.ExactTarget
+	s.Seed = g.Seed
+	s.Sections = nil
+	return s
 }
 
-func (g PlanGeneratorParameters) PullSegmentFunc() (func() PlanSegment, error) {
+// maximum nesting of sequences and generated stack cells
+const maxNesting = 8
+
+// nested returns the parameters of a sequence or generated stack cell s
+// within g. Unlike a section, s must specify its own segments: inheriting
+// g's would expand the same segment again, without end.
+func (g PlanGeneratorParameters) nested(s PlanGeneratorParameters) (n PlanGeneratorParameters, err error) {
+	if len(s.Segments) == 0 {
+		err = fmt.Errorf("mashu.PlanGeneratorParameters.nested: sequences and stack cells must specify segments")
+		return
+	}
+	if g.depth >= maxNesting {
+		err = fmt.Errorf("mashu.PlanGeneratorParameters.nested: sequences and stack cells nested deeper than %d", maxNesting)
+		return
+	}
+
+	n = g.section(s)
+	n.depth = g.depth + 1
+	n.sectionNumber = g.sectionNumber
+	return
+}
+
+// segment returns the parameters for the sources of segment t, with the
+// filters it sets replacing g's.
+func (g PlanGeneratorParameters) segment(t PlanSegment) PlanGeneratorParameters {
+	if t.RequiredTags != nil {
+		g.RequiredTags = t.RequiredTags
+	}
+	if t.DisallowedTags != nil {
+		g.DisallowedTags = t.DisallowedTags
+	}
+	if t.Tags != nil {
+		g.Tags = t.Tags
+	}
+	if t.Keys != nil {
+		g.Keys = t.Keys
+	}
+	return g
+}
+
+// pool identifies the sources g draws from and how; generators of the same
+// section with the same pool share a rotation, or queue, of sources.
+func (g PlanGeneratorParameters) pool() string {
+	tags := ""
+	if g.Tags != nil {
+		tags = g.Tags.String()
+	}
+	return fmt.Sprintf("%d %q %q %q %q %q %s %d %v %d %v %q %q %d", g.sectionNumber, g.RequiredTags, g.DisallowedTags, tags, g.Keys, g.Sampling,
+		g.Alignment, g.RepeatGap, g.NoRegionOverlap, g.MaxTagRun, g.UniqueStackSources, g.Mode, g.OrderBy, g.ClipsPerSource)
+}
+
+// matchesKey reports whether key is one of g's keys or matches one of its
+// globs; without keys any key matches.
+func (g PlanGeneratorParameters) matchesKey(key string) bool {
+	if g.Keys == nil {
+		return true
+	}
+	for _, pattern := range g.Keys {
+		if ok, _ := path.Match(pattern, key); ok || pattern == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (g PlanGeneratorParameters) filterKeys(keys []string) (filtered []string) {
+	for _, key := range keys {
+		if g.matchesKey(key) {
+			filtered = append(filtered, key)
+		}
+	}
+	return
+}
+
+// errSourcesExhausted ends ordered and coverage generations once every source
+// has contributed its clips.
+var errSourcesExhausted = errors.New("every source has contributed its clips")
+
+func (g PlanGeneratorParameters) mode() (string, error) {
+	switch g.Mode {
+	case "", "random":
+		return "random", nil
+	case "ordered", "coverage":
+		return g.Mode, nil
+	}
+	return "", fmt.Errorf("mashu.PlanGeneratorParameters: unknown mode '%s' (must be random, ordered or coverage)", g.Mode)
+}
+
+// sourceQueue returns keys in the order the ordered and coverage modes pull
+// them, each once per clip it contributes.
+func (g PlanGeneratorParameters) sourceQueue(c Catalog, keys []string, r *rand.Rand) (queue []string, err error) {
+	clips := int(g.ClipsPerSource)
+	if clips == 0 {
+		clips = 1
+	}
+	keys = append([]string(nil), keys...)
+
+	if g.Mode == "coverage" {
+		for i := 0; i < clips; i++ {
+			shuffleKeys(r, keys)
+			queue = append(queue, keys...)
+		}
+		return
+	}
+
+	if err = g.sortKeys(c, keys); err != nil {
+		return
+	}
+	for _, key := range keys {
+		for i := 0; i < clips; i++ {
+			queue = append(queue, key)
+		}
+	}
+	return
+}
+
+// sortKeys sorts keys by g.OrderBy: the key itself, or a metadata field
+// compared numerically when both values are numbers.
+func (g PlanGeneratorParameters) sortKeys(c Catalog, keys []string) (err error) {
+	if g.OrderBy == "" || g.OrderBy == "key" {
+		sort.Strings(keys)
+		return
+	}
+
+	values := make(map[string]string)
+	for _, key := range keys {
+		var s Source
+		if s, err = c.Lookup(key); err != nil {
+			return
+		}
+		values[key] = s.Metadata[g.OrderBy]
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		a, b := values[keys[i]], values[keys[j]]
+		if a == b {
+			return keys[i] < keys[j]
+		}
+		fa, aerr := strconv.ParseFloat(a, 64)
+		fb, berr := strconv.ParseFloat(b, 64)
+		if aerr == nil && berr == nil {
+			return fa < fb
+		}
+		return a < b
+	})
+	return
+}
+
+func (g PlanGeneratorParameters) sampling() (string, error) {
+	switch g.Sampling {
+	case "", "uniform":
+		return "uniform", nil
+	case "weight", "duration":
+		return g.Sampling, nil
+	}
+	return "", fmt.Errorf("mashu.PlanGeneratorParameters: unknown sampling '%s' (must be uniform, weight or duration)", g.Sampling)
+}
+
+// pickWeighted returns an index into weights with probability proportional
+// to its weight.
+func pickWeighted(r *rand.Rand, weights []float64) int {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+
+	n := r.Float64() * total
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(weights) - 1
+}
+
+// pickRegion picks one of regions according to g's sampling.
+func pickRegion(r *rand.Rand, g PlanGeneratorParameters, regions []TaggedRegion) TaggedRegion {
+	sampling, _ := g.sampling()
+	if sampling == "uniform" {
+		return regions[r.Intn(len(regions))]
+	}
+
+	weights := make([]float64, len(regions))
+	for i, region := range regions {
+		if sampling == "weight" {
+			weights[i] = region.weight()
+		} else {
+			weights[i] = float64(region.Duration())
+		}
+	}
+	return regions[pickWeighted(r, weights)]
+}
+
+func (g PlanGeneratorParameters) filtersTags() bool {
+	return len(g.RequiredTags)+len(g.DisallowedTags) > 0 || g.Tags != nil
+}
+
+// matchesTags reports whether tags satisfy the generator's tag expression and
+// carry every required tag and no disallowed tag.
+func (g PlanGeneratorParameters) matchesTags(tags []string) bool {
+	for _, requiredTag := range g.RequiredTags {
+		if !hasTag(tags, requiredTag) {
+			return false
+		}
+	}
+	for _, disallowedTag := range g.DisallowedTags {
+		if hasTag(tags, disallowedTag) {
+			return false
+		}
+	}
+	return g.Tags.Match(tags)
+}
+
+// segments pulled in search of one fitting the remaining time when
+// ExactTarget is set
+const exactTargetPulls = 16
+
+// fits reports whether the segment can be shortened to remaining or is no
+// longer; only blends have a fixed duration.
+func (t PlanSegment) fits(remaining Duration) bool {
+	return t.Blend == nil || blendDurations[*t.Blend].Duration <= remaining.Duration
+}
+
+func (g PlanGeneratorParameters) PullSegmentFunc(r *rand.Rand) (func() PlanSegment, error) {
 	type border struct {
 		Border  uint
 		Segment PlanSegment
@@ -51,7 +375,7 @@ func (g PlanGeneratorParameters) PullSegmentFunc() (func() PlanSegment, error) {
 	}
 
 	return func() PlanSegment {
-		n := uint(rand.Intn(int(tickets))) + 1
+		n := uint(r.Intn(int(tickets))) + 1
 		for _, b := range borders {
 			if n <= b.Border {
 				return b.Segment
@@ -62,25 +386,64 @@ func (g PlanGeneratorParameters) PullSegmentFunc() (func() PlanSegment, error) {
 	}, nil
 }
 
-func (g PlanGeneratorParameters) PullSourceFunc(p Project) (fn func(n int) ([]Source, error), err error) {
-	var keys []string
-	if keys, err = p.Catalog.Keys(context.TODO()); err != nil {
+// matchingSources returns the shuffled keys of every source with a region
+// valid for g, filtering through the catalog index when one is maintained.
+// Unless g samples uniformly, the sampling weight of each key is returned too.
+func (g PlanGeneratorParameters) matchingSources(c Catalog, r *rand.Rand) (keys []string, weights []float64, err error) {
+	var sampling string
+	if sampling, err = g.sampling(); err != nil {
 		return
 	}
 
-	if len(g.RequiredTags)+len(g.DisallowedTags) > 0 {
-		var validKeys []string
-		for _, key := range keys {
-			var s Source
-			if s, err = p.Catalog.Lookup(key); err != nil {
-				return
-			}
+	if !g.filtersTags() && sampling == "uniform" {
+		if keys, err = c.Keys(context.TODO()); err != nil {
+			return
+		}
+		keys = g.filterKeys(keys)
+		sort.Strings(keys)
+		shuffleKeys(r, keys)
+		return
+	}
 
-			if len(validRegions(g, s.Regions)) > 0 {
-				validKeys = append(validKeys, key)
-			}
+	var idx *CatalogIndex
+	if ic, ok := c.(indexedCatalog); ok {
+		idx, err = ic.Index(context.TODO())
+	} else {
+		idx, err = buildCatalogIndex(context.TODO(), c)
+	}
+	if err != nil {
+		return
+	}
+
+	var durations map[string]time.Duration
+	keys, durations = idx.Match(g)
+	keys = g.filterKeys(keys)
+	shuffleKeys(r, keys)
+
+	switch sampling {
+	case "weight":
+		weights = make([]float64, len(keys))
+		for i, key := range keys {
+			weights[i] = idx.weight(key)
+		}
+	case "duration":
+		weights = make([]float64, len(keys))
+		for i, key := range keys {
+			weights[i] = float64(durations[key])
 		}
-		keys = validKeys
+	}
+
+	return
+}
+
+// PullSourceFunc returns a function pulling n sources for the next segment.
+// Sources that would break the generator's constraints given the history h
+// are skipped; if every matching source would, pulling fails.
+func (g PlanGeneratorParameters) PullSourceFunc(p Project, h *generatorHistory, r *rand.Rand) (fn func(n int) ([]Source, error), err error) {
+	var keys []string
+	var weights []float64
+	if keys, weights, err = g.matchingSources(p.Catalog, r); err != nil {
+		return
 	}
 
 	if len(keys) == 0 {
@@ -88,18 +451,114 @@ func (g PlanGeneratorParameters) PullSourceFunc(p Project) (fn func(n int) ([]So
 		return
 	}
 
+	var mode string
+	if mode, err = g.mode(); err != nil {
+		return
+	}
+
+	// usable reports whether key may be pulled next, looking it up
+	usable := func(key string, picked map[string]bool) (s Source, ok bool, err error) {
+		if h.repeats(key, g.RepeatGap) || h.inStack(key) || (picked[key] && (g.UniqueStackSources || g.RepeatGap > 0)) {
+			return
+		}
+		if s, err = p.Catalog.Lookup(key); err != nil {
+			return
+		}
+		ok = len(h.usableRegions(g, s)) > 0
+		return
+	}
+
+	if mode != "random" {
+		var queue []string
+		if queue, err = g.sourceQueue(p.Catalog, keys, r); err != nil {
+			return
+		}
+		// an extension continues after the clips the sources already gave
+		for _, key := range h.recent[:h.replayed] {
+			for i := range queue {
+				if queue[i] == key {
+					queue = append(queue[:i], queue[i+1:]...)
+					break
+				}
+			}
+		}
+		queued := len(queue)
+
+		fn = func(n int) (sources []Source, err error) {
+			picked := make(map[string]bool)
+			for len(sources) < n {
+				if len(queue) == 0 {
+					return nil, errSourcesExhausted
+				}
+
+				// take the first usable key, so that a key blocked by the
+				// constraints, such as the one just used when RepeatGap is
+				// set, waits for the next pull
+				var s Source
+				ok := false
+				i := 0
+				for ; !ok && i < len(queue); i++ {
+					if s, ok, err = usable(queue[i], picked); err != nil {
+						return
+					}
+				}
+				if !ok {
+					return nil, fmt.Errorf("mashu.PlanGeneratorParameters.PullSourceFunc: %d of %d queued clips left: %w",
+						len(queue), queued, g.constraintError(len(keys)))
+				}
+
+				queue = append(queue[:i-1], queue[i:]...)
+				picked[s.Key] = true
+				sources = append(sources, s)
+			}
+			return
+		}
+		return
+	}
+
 	idx := 0
 	fn = func(n int) (sources []Source, err error) {
-		sources = make([]Source, n)
-		for i := 0; i < n; i++ {
-			if idx == len(keys) {
-				idx = 0
-				rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		picked := make(map[string]bool)
+
+		for len(sources) < n {
+			var s Source
+			ok := false
+			if weights != nil {
+				// rule out unusable keys until one is usable or none are left
+				w := append([]float64(nil), weights...)
+				for total := len(keys); !ok && total > 0; total-- {
+					i := pickWeighted(r, w)
+					if w[i] == 0 {
+						break
+					}
+					if s, ok, err = usable(keys[i], picked); err != nil {
+						return
+					}
+					w[i] = 0
+				}
+			} else {
+				if idx == len(keys) {
+					idx = 0
+					shuffleKeys(r, keys)
+				}
+				// prefer keys not yet used in this round
+				for j := 0; !ok && j < len(keys); j++ {
+					k := (idx + j) % len(keys)
+					if s, ok, err = usable(keys[k], picked); err != nil {
+						return
+					}
+					if ok && k >= idx {
+						keys[idx], keys[k] = keys[k], keys[idx]
+						idx += 1
+					}
+				}
 			}
-			if sources[i], err = p.Catalog.Lookup(keys[idx]); err != nil {
-				return
+			if !ok {
+				return nil, g.constraintError(len(keys))
 			}
-			idx += 1
+
+			picked[s.Key] = true
+			sources = append(sources, s)
 		}
 
 		return
@@ -107,88 +566,130 @@ func (g PlanGeneratorParameters) PullSourceFunc(p Project) (fn func(n int) ([]So
 	return
 }
 
-func planCreate(p Project, prefix string) (name string, f *os.File, err error) {
-	for {
-		b := make([]byte, 16)
-		if _, err = crand.Read(b); err != nil {
-			return
+// excludesTags reports whether a region carrying tags is excluded by the
+// generator: it has a disallowed tag or matches a negated term of the tag
+// expression.
+func (g PlanGeneratorParameters) excludesTags(tags []string) bool {
+	for _, disallowedTag := range g.DisallowedTags {
+		if hasTag(tags, disallowedTag) {
+			return true
 		}
-		name = fmt.Sprintf("%s-%x", prefix, b)
-		path := filepath.Join(p.Path, "plan", name+".json")
-		if _, err = os.Stat(path); !errors.Is(err, os.ErrNotExist) {
-			err = nil
-			continue
-		}
-
-		f, err = os.Create(path)
-		return
 	}
+	return g.Tags.excludes(tags)
 }
 
-func validRegions(g PlanGeneratorParameters, regions []TaggedRegion) (validRegions []Region) {
-region:
+// validRegions returns the parts of regions matching g's tag filters that do
+// not overlap any excluded region, keeping their tags and weights; parts
+// shorter than the alignment are dropped.
+func validRegions(g PlanGeneratorParameters, regions []TaggedRegion) (validRegions []TaggedRegion) {
+	var exclusions []Region
 	for _, r := range regions {
-	requiredTag:
-		for _, requiredTag := range g.RequiredTags {
-			for _, includedTag := range r.Tags {
-				if requiredTag == includedTag {
-					continue requiredTag
-				}
-			}
-			continue region
+		if g.excludesTags(r.Tags) {
+			exclusions = append(exclusions, r.Region)
 		}
-		for _, disallowedTag := range g.DisallowedTags {
-			for _, includedTag := range r.Tags {
-				if disallowedTag == includedTag {
-					continue region
-				}
+	}
+
+	for _, r := range regions {
+		if !g.matchesTags(r.Tags) {
+			continue
+		}
+		for _, part := range r.Region.Subtract(exclusions) {
+			if part.Duration() > 0 && part.Duration() >= g.Alignment.Duration {
+				r.Region = part
+				validRegions = append(validRegions, r)
 			}
 		}
-		validRegions = append(validRegions, r.Region)
 	}
 
 	return
 }
 
-func planConcat(p Project, names []string) (name string, err error) {
-	plan := Plan{Concat: &PlanConcat{Input: names}}
-
-	var f *os.File
-	if plan.Name, f, err = planCreate(p, "concat"); err != nil {
-		return
+func (gen *Generation) planConcat(names []string) (name string, err error) {
+	var d Duration
+	for _, n := range names {
+		d = d.Add(gen.durations[n])
 	}
-	defer f.Close()
-
-	name = plan.Name
+	return gen.add("concat", d, Plan{Concat: &PlanConcat{Input: names}})
+}
 
-	e := json.NewEncoder(f)
-	if err = e.Encode(plan); err != nil {
-		return
+// planConcats concatenates names, in order, through a tree of concats with at
+// most maxConcat inputs each and returns its root.
+func (gen *Generation) planConcats(maxConcat uint, names []string) (rootPlan string, err error) {
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	if maxConcat < 2 {
+		return gen.planConcat(names)
 	}
 
-	return
-}
+	max := int(maxConcat)
+	layers := [][]string{nil}
+	for _, name := range names {
+		for layer, group := range layers {
+			if len(group) == max {
+				var concat string
+				if concat, err = gen.planConcat(group); err != nil {
+					return
+				}
 
-func planStack(p Project, target Duration, names []string) (name string, err error) {
-	plan := Plan{Stack: &PlanStack{Input: names, Duration: target}}
+				if len(layers) == layer+1 {
+					layers = append(layers, []string{concat})
+				} else {
+					layers[layer+1] = append(layers[layer+1], concat)
+				}
 
-	var f *os.File
-	if plan.Name, f, err = planCreate(p, "stack"); err != nil {
-		return
+				layers[layer] = nil
+			}
+		}
+		layers[0] = append(layers[0], name)
+	}
+
+	for len(layers) > 1 {
+		if len(layers[0]) == max {
+			var concat string
+			if concat, err = gen.planConcat(layers[0]); err != nil {
+				return
+			}
+			layers[1] = append(layers[1], concat)
+			layers = layers[1:]
+		} else if len(layers[0])+len(layers[1]) <= max {
+			layers[1] = append(layers[1], layers[0]...)
+			layers = layers[1:]
+		} else {
+			split := len(layers[1]) - (max - len(layers[0]))
+			layers[0] = append(layers[1][split:], layers[0]...)
+			layers[1] = layers[1][:split]
+		}
 	}
-	defer f.Close()
 
-	name = plan.Name
+	if len(layers[0]) == 1 {
+		return layers[0][0], nil
+	}
+	return gen.planConcat(layers[0])
+}
 
-	e := json.NewEncoder(f)
-	if err = e.Encode(plan); err != nil {
-		return
+// planTrim trims the output of the plan name to d, wrapping it in a concat
+// unless it is one.
+func (gen *Generation) planTrim(name string, d Duration) (trimmed string, err error) {
+	plan := gen.plans[name]
+	if plan.Concat == nil {
+		if name, err = gen.planConcat([]string{name}); err != nil {
+			return
+		}
+		plan = gen.plans[name]
 	}
 
-	return
+	plan.Concat.Duration = &d
+	gen.plans[name] = plan
+	gen.durations[name] = d
+	return name, nil
+}
+
+func (gen *Generation) planStack(target Duration, names []string) (name string, err error) {
+	return gen.add("stack", target, Plan{Stack: &PlanStack{Input: names, Duration: target}})
 }
 
-func planBlend(p Project, g PlanGeneratorParameters, blend string, pullSource func(n int) ([]Source, error)) (name string, d Duration, err error) {
+func (gen *Generation) planBlend(g PlanGeneratorParameters, blend string, pullSource func(n int) ([]Source, error)) (name string, d Duration, err error) {
 	att := make(Attachments)
 	switch blend {
 	case "demon-slayer-scrolls":
@@ -210,8 +711,7 @@ func planBlend(p Project, g PlanGeneratorParameters, blend string, pullSource fu
 			Duration{time.Second * 11},
 			Duration{time.Second * 11},
 		}
-		outDuration := Duration{time.Second * 20}
-		d = outDuration
+		d = blendDurations[blend]
 
 		var s []Source
 		if s, err = pullSource(16); err != nil {
@@ -220,7 +720,7 @@ func planBlend(p Project, g PlanGeneratorParameters, blend string, pullSource fu
 
 		for i, src := range s {
 			var clipName string
-			if clipName, _, err = planClip(p, g, inDuration[i], src); err != nil {
+			if clipName, _, err = gen.planClip(g, inDuration[i], src); err != nil {
 				return
 			}
 			att[fmt.Sprintf("video.%03d", i+1)] = Input(clipName)
@@ -230,21 +730,7 @@ func planBlend(p Project, g PlanGeneratorParameters, blend string, pullSource fu
 		return
 	}
 
-	plan := Plan{Blend: &PlanBlend{Name: blend, Attachments: att}}
-
-	var f *os.File
-	if plan.Name, f, err = planCreate(p, "blend"); err != nil {
-		return
-	}
-	defer f.Close()
-
-	name = plan.Name
-
-	e := json.NewEncoder(f)
-	if err = e.Encode(plan); err != nil {
-		return
-	}
-
+	name, err = gen.add("blend", d, Plan{Blend: &PlanBlend{Name: blend, Attachments: att}})
 	return
 
 	// TODO this is super hardcoded; embed json to configure this?
@@ -252,164 +738,377 @@ func planBlend(p Project, g PlanGeneratorParameters, blend string, pullSource fu
 	return
 }
 
-func planClip(p Project, g PlanGeneratorParameters, target Duration, s Source) (name string, d Duration, err error) {
+func (gen *Generation) planClip(g PlanGeneratorParameters, target Duration, s Source) (name string, d Duration, err error) {
 	plan := Plan{Clip: &PlanClip{SrcKey: &s.Key}}
+	d = target
 
-	var f *os.File
-	if plan.Name, f, err = planCreate(p, "clip"); err != nil {
+	regions := gen.h.usableRegions(g, s)
+	if len(regions) == 0 {
+		err = fmt.Errorf("mashu.planClip: no region of source '%s' left that satisfies the generator constraints", s.Key)
 		return
 	}
-	defer f.Close()
-
-	name = plan.Name
-	d = target
-
-	regions := validRegions(g, s.Regions)
-	region := regions[rand.Intn(len(regions))]
+	var region TaggedRegion
+	if g.Mode == "ordered" {
+		region = gen.h.nextRegion(g, s.Key, regions)
+	} else {
+		region = pickRegion(gen.r, g, regions)
+	}
 	regionDuration := region.Duration()
 
 	if regionDuration > d.Duration {
 		plan.Clip.Region.Start = region.Start.Add(Duration{time.Duration(
-			rand.Int63n(int64(region.End.Duration - region.Start.Duration - d.Duration)))})
+			gen.r.Int63n(int64(region.End.Duration - region.Start.Duration - d.Duration)))})
 		plan.Clip.Region.End = plan.Clip.Region.Start.Add(d)
 	} else {
 		d = Duration{regionDuration.Truncate(g.Alignment.Duration)}
 		plan.Clip.Region.Start = region.Start
 		plan.Clip.Region.End = region.Start.Add(d)
 	}
-
-	e := json.NewEncoder(f)
-	if err = e.Encode(plan); err != nil {
+	if d.Duration == 0 {
+		err = fmt.Errorf("mashu.planClip: region %v of source '%s' is shorter than the alignment", region.Region, s.Key)
 		return
 	}
+	gen.h.record(s.Key, plan.Clip.Region, region.Tags)
 
+	name, err = gen.add("clip", d, plan)
 	return
 }
 
-func (p Project) Generate() (err error) {
-	rand.Seed(time.Now().UnixNano())
+// Generate plans a mashup from the project's generator.json in memory. A
+// non-nil seed overrides the generator's; the seed used is recorded in the
+// root plan.
+func (p Project) Generate(seed *int64) (gen *Generation, err error) {
 	var g PlanGeneratorParameters
 	if err = decodeJsonFromFile(filepath.Join(p.Path, "generator.json"), &g); err != nil {
 		return
 	}
 
-	var pullSeg func() PlanSegment
-	if pullSeg, err = g.PullSegmentFunc(); err != nil {
-		return
+	if seed != nil {
+		g.Seed = seed
+	}
+	if g.Seed == nil {
+		s := time.Now().UnixNano()
+		g.Seed = &s
 	}
+	gen = newGeneration(p, *g.Seed)
 
-	var pullSource func(n int) ([]Source, error)
-	if pullSource, err = g.PullSourceFunc(p); err != nil {
-		return
+	var rootPlan string
+	if len(g.Sections) == 0 {
+		if rootPlan, err = gen.generate(g); err != nil {
+			return nil, err
+		}
+		gen.Target = Duration{g.Target.Truncate(g.Alignment.Duration)}
+	} else {
+		names := make([]string, len(g.Sections))
+		for i, section := range g.Sections {
+			section = g.section(section)
+			section.sectionNumber = i + 1
+			if mode, _ := section.mode(); mode == "random" && section.Target.Duration == 0 {
+				return nil, fmt.Errorf("mashu.Project.Generate: section %d must specify a target", i+1)
+			}
+			if names[i], err = gen.generate(section); err != nil {
+				return nil, fmt.Errorf("mashu.Project.Generate: section %d: %w", i+1, err)
+			}
+			gen.Target = gen.Target.Add(Duration{section.Target.Truncate(section.Alignment.Duration)})
+		}
+		if rootPlan, err = gen.planConcats(g.MaxConcat, names); err != nil {
+			return
+		}
 	}
 
-	var d Duration
-	var names [][]string
-	names = append(names, make([]string, 0))
-	for d.Duration < g.Target.Duration {
-		for layer, group := range names {
-			if len(group) == int(g.MaxConcat) {
-				var name string
-				if name, err = planConcat(p, group); err != nil {
-					return
-				}
+	root := gen.plans[rootPlan]
+	root.Seed = g.Seed
+	gen.plans[rootPlan] = root
+	gen.Root = rootPlan
+	gen.Duration = gen.durations[rootPlan]
 
-				if len(names) == layer+1 {
-					names = append(names, []string{name})
-				} else {
-					names[layer+1] = append(names[layer+1], name)
-				}
+	return
+}
 
-				names[layer] = make([]string, 0)
-			}
+// regionTags returns the tags of the regions of s covering span.
+func regionTags(s Source, span Region) (tags []string) {
+	for _, r := range s.Regions {
+		if r.Start.Duration <= span.Start.Duration && span.End.Duration <= r.End.Duration {
+			tags = append(tags, r.Tags...)
 		}
+	}
+	return
+}
 
-		t := pullSeg()
-		if t.Clip != nil {
-			var s []Source
-			if s, err = pullSource(1); err != nil {
+// replay records the clips under name into h in playing order, with the tags
+// of the regions they were cut from, so that an extension keeps to the
+// generator's constraints across the join. The clips of a stack or blend are
+// one segment.
+func (t renderTree) replay(c Catalog, h *generatorHistory, name string, grouped bool) (err error) {
+	plan := t.plans[name]
+	switch {
+	case plan.Clip != nil && plan.Clip.SrcKey != nil:
+		// a source since deleted from the catalog no longer has tags
+		var s Source
+		if s, err = c.Lookup(*plan.Clip.SrcKey); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		err = nil
+		h.record(*plan.Clip.SrcKey, plan.Clip.Region, regionTags(s, plan.Clip.Region))
+	case plan.Concat != nil:
+		for _, input := range plan.inputs() {
+			if err = t.replay(c, h, input, grouped); err != nil {
 				return
 			}
-
-			var name string
-			var clipDuration Duration
-			if name, clipDuration, err = planClip(p, g, t.Clip.RandomTruncated(g.Alignment), s[0]); err != nil {
+		}
+		return
+	default:
+		for _, input := range plan.inputs() {
+			if err = t.replay(c, h, input, true); err != nil {
 				return
 			}
-			d = d.Add(clipDuration)
-			names[0] = append(names[0], name)
-		} else if t.Stack != nil {
-			var s []Source
+		}
+	}
+
+	if !grouped {
+		h.next()
+	}
+	return
+}
+
+// Extend generates d more of the project's mashup in memory and appends it to
+// the current generation, reusing every existing plan and render: a new root
+// concat joins the previous root, whose render stays usable as is, to the
+// new part. The extension follows generator.json, or
+// its last section, continuing the ordered or coverage queue after the
+// clips already generated; unless seed is non-nil, its seed derives from the
+// one recorded in the root.
+func (p Project) Extend(d Duration, seed *int64) (gen *Generation, err error) {
+	var g PlanGeneratorParameters
+	if err = decodeJsonFromFile(filepath.Join(p.Path, "generator.json"), &g); err != nil {
+		return
+	}
+	if len(g.Sections) > 0 {
+		g = g.section(g.Sections[len(g.Sections)-1])
+	}
+	g.Target = d
+
+	var t renderTree
+	if t, err = p.loadRenderTree(); err != nil {
+		return
+	}
+	previous := t.plans[t.root]
+
+	// the nth extension uses the nth number drawn from the root's seed
+	lineage := previous.Seed
+	if lineage == nil {
+		s := time.Now().UnixNano()
+		lineage = &s
+	}
+	extensions := previous.Extensions + 1
+	if seed == nil {
+		r := rand.New(rand.NewSource(*lineage))
+		var s int64
+		for i := uint(0); i < extensions; i++ {
+			s = r.Int63()
+		}
+		seed = &s
+	}
+
+	gen = newGeneration(p, *seed)
+	if err = t.replay(p.Catalog, gen.h, t.root, false); err != nil {
+		return nil, err
+	}
+	gen.h.replayed = len(gen.h.recent)
+	// existing plans are printed but, being absent from the order, not committed
+	for name, plan := range t.plans {
+		gen.plans[name] = plan
+		gen.durations[name] = t.duration(name)
+	}
+
+	var extension string
+	if extension, err = gen.generate(g); errors.Is(err, errSourcesExhausted) {
+		return nil, fmt.Errorf("mashu.Project.Extend: nothing left to extend '%s' with: %w", p.Path, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var rootPlan string
+	if rootPlan, err = gen.planConcat([]string{t.root, extension}); err != nil {
+		return
+	}
+
+	root := gen.plans[rootPlan]
+	root.Seed = lineage
+	root.Extensions = extensions
+	gen.plans[rootPlan] = root
+	gen.Root = rootPlan
+	gen.Target = gen.durations[t.root].Add(Duration{d.Truncate(g.Alignment.Duration)})
+	gen.Duration = gen.durations[rootPlan]
+
+	return
+}
+
+// planSegment plans segment t, shortened to remaining when g targets an
+// exact duration, and returns its name and duration.
+func (gen *Generation) planSegment(g PlanGeneratorParameters, t PlanSegment, remaining Duration) (name string, d Duration, err error) {
+	sg := g.segment(t)
+	var pullSource func(n int) ([]Source, error)
+	if pullSource, err = gen.pullSourceFunc(sg); err != nil {
+		return
+	}
+
+	if t.Clip != nil {
+		var s []Source
+		if s, err = pullSource(1); err != nil {
+			return
+		}
+
+		clipTarget := t.Clip.RandomTruncated(gen.r, g.Alignment)
+		if g.ExactTarget && clipTarget.Duration > remaining.Duration {
+			clipTarget = remaining
+		}
+
+		return gen.planClip(sg, clipTarget, s[0])
+	}
+	if t.Stack != nil {
+		var s []Source
+		if t.Stack.Cells == nil {
 			if s, err = pullSource(int(t.Stack.Count)); err != nil {
 				return
 			}
+		}
 
-			target := t.Stack.Duration.RandomTruncated(g.Alignment)
-			snames := make([]string, t.Stack.Count)
-			for i, source := range s {
-				if snames[i], _, err = planClip(p, g, target, source); err != nil {
+		stackTarget := t.Stack.Duration.RandomTruncated(gen.r, g.Alignment)
+		if g.ExactTarget && stackTarget.Duration > remaining.Duration {
+			stackTarget = remaining
+		}
+		// generated cells pull their sources separately; the history keeps
+		// each cell from the sources of the cells before it
+		var used map[string]bool
+		if t.Stack.Cells != nil && sg.UniqueStackSources {
+			used = make(map[string]bool)
+			gen.h.stacks = append(gen.h.stacks, used)
+			defer func() { gen.h.stacks = gen.h.stacks[:len(gen.h.stacks)-1] }()
+		}
+		snames := make([]string, t.Stack.Count)
+		for i := range snames {
+			if t.Stack.Cells != nil {
+				var cell PlanGeneratorParameters
+				if cell, err = sg.nested(*t.Stack.Cells); err != nil {
 					return
 				}
+				cell.Target = stackTarget
+				cell.ExactTarget = true
+				start := len(gen.h.recent)
+				snames[i], err = gen.generate(cell)
+				if used != nil {
+					for _, key := range gen.h.recent[start:] {
+						used[key] = true
+					}
+				}
+			} else {
+				snames[i], _, err = gen.planClip(sg, stackTarget, s[i])
 			}
-
-			var name string
-			if name, err = planStack(p, target, snames); err != nil {
-				return
-			}
-			d = d.Add(target)
-			names[0] = append(names[0], name)
-		} else if t.Blend != nil {
-			var name string
-			var target Duration
-			if name, target, err = planBlend(p, g, *t.Blend, pullSource); err != nil {
+			if err != nil {
 				return
 			}
+		}
 
-			d = d.Add(target)
-			names[0] = append(names[0], name)
-		} else {
-			return fmt.Errorf("mashu.Project.Generate: invalid segment in generator configuration")
+		name, err = gen.planStack(stackTarget, snames)
+		return name, stackTarget, err
+	}
+	if t.Blend != nil {
+		return gen.planBlend(sg, *t.Blend, pullSource)
+	}
+	if t.Sequence != nil {
+		var sequence PlanGeneratorParameters
+		if sequence, err = sg.nested(*t.Sequence); err != nil {
+			return
+		}
+		if g.ExactTarget && sequence.Target.Duration > remaining.Duration {
+			sequence.Target = remaining
+			sequence.ExactTarget = true
 		}
+
+		if name, err = gen.generate(sequence); err != nil {
+			return
+		}
+		return name, gen.durations[name], nil
 	}
 
-	for len(names) > 1 {
-		if len(names[0]) == int(g.MaxConcat) {
-			var name string
-			if name, err = planConcat(p, names[0]); err != nil {
-				return
-			}
-			names[1] = append(names[1], name)
-			names = names[1:]
-		} else if len(names[0])+len(names[1]) <= int(g.MaxConcat) {
-			names[1] = append(names[1], names[0]...)
-			names = names[1:]
-		} else {
-			split := len(names[1]) - (int(g.MaxConcat) - len(names[0]))
-			names[0] = append(names[1][split:], names[0]...)
-			names[1] = names[1][:split]
+	return "", Duration{}, fmt.Errorf("mashu.Generation.planSegment: invalid segment in generator configuration")
+}
+
+// generate plans a subtree of the generation following g and returns the
+// name of its root plan.
+func (gen *Generation) generate(g PlanGeneratorParameters) (rootPlan string, err error) {
+	var pullSeg func() PlanSegment
+	if pullSeg, err = g.PullSegmentFunc(gen.r); err != nil {
+		return
+	}
+
+	target := Duration{g.Target.Truncate(g.Alignment.Duration)}
+
+	var mode string
+	if mode, err = g.mode(); err != nil {
+		return
+	}
+	if target.Duration == 0 {
+		if mode == "random" {
+			return "", fmt.Errorf("mashu.Generation.generate: must specify a target")
 		}
+		g.ExactTarget = false
 	}
 
-	var rootPlan string
-	if len(names[0]) == 1 {
-		rootPlan = names[0][0]
-	} else if len(names[0]) > 1 {
-		if rootPlan, err = planConcat(p, names[0]); err != nil {
-			return
+	// segments with their own pools exhaust their queues apart; the
+	// generation ends once every pool is exhausted
+	pools := make(map[string]bool)
+	for _, s := range g.Segments {
+		if s.Tickets > 0 {
+			pools[g.segment(s).pool()] = true
+		}
+	}
+	exhausted := make(map[string]bool)
+	pull := func() (t PlanSegment) {
+		for t = pullSeg(); exhausted[g.segment(t).pool()]; t = pullSeg() {
 		}
-	} else {
-		return fmt.Errorf("mashu.Project.Generate: unable to determine root plan")
 		return
 	}
 
-	if err = os.Symlink(filepath.Join("plan", rootPlan+".json"),
-		filepath.Join(p.Path, "plan.json")); err != nil {
-		return
+	var d Duration
+	var names []string
+	for target.Duration == 0 || d.Duration < target.Duration {
+		remaining := Duration{target.Duration - d.Duration}
+		t := pull()
+		for i := 0; g.ExactTarget && i < exactTargetPulls && !t.fits(remaining); i++ {
+			t = pull()
+		}
+
+		var name string
+		var segmentDuration Duration
+		if name, segmentDuration, err = gen.planSegment(g, t, remaining); errors.Is(err, errSourcesExhausted) {
+			err = nil
+			if exhausted[g.segment(t).pool()] = true; len(exhausted) == len(pools) {
+				break
+			}
+			continue
+		} else if err != nil {
+			return
+		}
+		d = d.Add(segmentDuration)
+		names = append(names, name)
+		gen.h.next()
+	}
+
+	if len(names) == 0 && len(exhausted) > 0 {
+		return "", errSourcesExhausted
+	} else if len(names) == 0 {
+		return "", fmt.Errorf("mashu.Generation.generate: unable to determine root plan")
 	}
-	if err = os.Symlink(filepath.Join("render", rootPlan+"."+strings.ToLower(p.Format.Format)),
-		filepath.Join(p.Path, "output."+strings.ToLower(p.Format.Format))); err != nil {
+	if rootPlan, err = gen.planConcats(g.MaxConcat, names); err != nil {
 		return
 	}
 
+	// a segment that could not be shortened overshot the target
+	if g.ExactTarget && d.Duration > target.Duration {
+		rootPlan, err = gen.planTrim(rootPlan, target)
+	}
+
 	return
 }
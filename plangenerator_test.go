@@ -0,0 +1,149 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExtendOrdered(t *testing.T) {
+	generator := `{"Target":"6s","Alignment":"1s","MaxConcat":4,"Mode":"ordered","Segments":[{"Clip":{"Start":"2s","End":"2s"},"Tickets":1}]}`
+	p := testProject(t, generator, 6, time.Minute)
+
+	gen, err := p.Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gen.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+	previous := gen.Root
+
+	for _, want := range []string{"abcd", "abcde", "abcdef"} {
+		if gen, err = p.Extend(Duration{2 * time.Second}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err = gen.Commit(true); err != nil {
+			t.Fatal(err)
+		}
+
+		// the extension continues the queue under a new root over the
+		// previous one
+		root := gen.plans[gen.Root]
+		if root.Extensions != uint(len(want)-3) || root.Concat.Input[0] != previous {
+			t.Errorf("extended root %+v, want one over %s", root, previous)
+		}
+		previous = gen.Root
+		var tree renderTree
+		if tree, err = p.loadRenderTree(); err != nil {
+			t.Fatal(err)
+		}
+		h := newGeneratorHistory()
+		if err = tree.replay(p.Catalog, h, tree.root, false); err != nil {
+			t.Fatal(err)
+		}
+		var keys string
+		for _, key := range h.recent {
+			keys += key
+		}
+		if keys != want {
+			t.Errorf("extended clips from %s, want %s", keys, want)
+		}
+	}
+
+	if _, err = p.Extend(Duration{2 * time.Second}, nil); err == nil {
+		t.Error("extended with every source used, want an error")
+	}
+}
+
+func TestGeneratorExactTarget(t *testing.T) {
+	generator := `{"Target":"47s","Alignment":"1s","MaxConcat":4,"ExactTarget":true,"Segments":[{"Clip":{"Start":"3s","End":"9s"},"Tickets":2},
+		{"Stack":{"Count":2,"Duration":{"Start":"4s","End":"6s"}},"Tickets":1}]}`
+	for seed := int64(0); seed < 30; seed++ {
+		gen, err := testProject(t, generator, 4, time.Minute).Generate(&seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gen.Duration != gen.Target || gen.Target.Duration != 47*time.Second {
+			t.Errorf("seed %d: generated %v of target %v, want 47s", seed, gen.Duration, gen.Target)
+		}
+	}
+}
+
+func TestGeneratorSections(t *testing.T) {
+	generator := `{"Alignment":"1s","MaxConcat":2,"ExactTarget":true,"Segments":[{"Clip":{"Start":"2s","End":"4s"},"Tickets":1}],
+		"Sections":[{"Target":"6s","Keys":["a"]},{"Target":"11s","Keys":["b"]},{"Target":"8s","Keys":["c"]}]}`
+	for seed := int64(0); seed < 10; seed++ {
+		gen, err := testProject(t, generator, 3, time.Minute).Generate(&seed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the clips play section by section, each lasting its target
+		var keys string
+		durations := make(map[string]time.Duration)
+		var walk func(name string)
+		walk = func(name string) {
+			plan := gen.plans[name]
+			if plan.Clip != nil {
+				if key := *plan.Clip.SrcKey; !strings.HasSuffix(keys, key) {
+					keys += key
+				}
+				durations[*plan.Clip.SrcKey] += plan.Clip.Region.Duration()
+			}
+			for _, input := range plan.inputs() {
+				walk(input)
+			}
+		}
+		walk(gen.Root)
+
+		if keys != "abc" {
+			t.Errorf("seed %d: sections played as %s, want abc", seed, keys)
+		}
+		for key, want := range map[string]time.Duration{"a": 6 * time.Second, "b": 11 * time.Second, "c": 8 * time.Second} {
+			if durations[key] != want {
+				t.Errorf("seed %d: section of %s lasts %v, want %v", seed, key, durations[key], want)
+			}
+		}
+		if gen.Duration != gen.Target || gen.Target.Duration != 25*time.Second {
+			t.Errorf("seed %d: generated %v of target %v, want 25s", seed, gen.Duration, gen.Target)
+		}
+		if root := gen.plans[gen.Root]; len(root.inputs()) > 2 {
+			t.Errorf("seed %d: root concat of %d inputs, want at most MaxConcat 2", seed, len(root.inputs()))
+		}
+	}
+}
+
+func TestGeneratorSegmentPools(t *testing.T) {
+	segments := `"Segments":[{"Clip":{"Start":"2s","End":"2s"},"Tickets":1,"RequiredTags":["ta"]},{"Clip":{"Start":"3s","End":"3s"},"Tickets":1,"Keys":["[bd]"]}]`
+	for _, generator := range []string{
+		`{"Target":"40s","Alignment":"1s","MaxConcat":4,` + segments + `}`,
+		`{"Alignment":"1s","MaxConcat":4,"Mode":"coverage","ClipsPerSource":2,` + segments + `}`,
+	} {
+		for seed := int64(0); seed < 10; seed++ {
+			gen, err := testProject(t, generator, 5, time.Minute).Generate(&seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the 2s clips come from sources tagged ta, the 3s ones from b
+			// and d
+			counts := make(map[string]int)
+			for _, clip := range generatedClips(gen) {
+				key := *clip.SrcKey
+				counts[key]++
+				if clip.Region.Duration() == 2*time.Second && !strings.Contains("ace", key) ||
+					clip.Region.Duration() == 3*time.Second && !strings.Contains("bd", key) {
+					t.Errorf("seed %d: %v clip from %s, outside its segment's pool", seed, clip.Region.Duration(), key)
+				}
+			}
+			if strings.Contains(generator, "coverage") {
+				for _, key := range []string{"a", "b", "c", "d", "e"} {
+					if counts[key] != 2 {
+						t.Errorf("seed %d: coverage took %d clips of %s, want 2", seed, counts[key], key)
+					}
+				}
+			}
+		}
+	}
+}
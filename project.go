@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,6 +29,8 @@ type PlanBlend struct {
 
 type PlanConcat struct {
 	Input []string
+	// trim the output to this duration
+	Duration *Duration `json:",omitempty"`
 }
 
 type Plan struct {
@@ -36,12 +39,20 @@ type Plan struct {
 	Clip   *PlanClip
 	Concat *PlanConcat
 	Stack  *PlanStack
+	// seed the plan was generated with, recorded in root plans
+	Seed *int64 `json:",omitempty"`
+	// times the generation was extended, each extension seeded from Seed
+	Extensions uint `json:",omitempty"`
+	// keep the render when executing with pruning
+	Pinned bool `json:",omitempty"`
 }
 
 type Project struct {
 	Path    string
 	Catalog Catalog
 	Format  Format
+
+	pruner *renderPruner
 }
 
 // TODO global stamping toggle? maybe disalbe when format has no stamp
@@ -72,35 +83,124 @@ func NewProject(path string, c Catalog) (p Project, err error) {
 	return
 }
 
-func (p Project) Execute() error {
-	var plan Plan
-	if err := decodeJsonFromFile(filepath.Join(p.Path, "plan.json"), &plan); err != nil {
-		return fmt.Errorf("mashu.Project.Execute: unable to load plan ('%s/plan.json'): %w", p.Path, err)
+// Execute renders the project's root plan. With prune, the render of a plan
+// is deleted once every plan consuming it has rendered, unless it is the root
+// or pinned.
+func (p Project) Execute(prune bool) error {
+	t, err := p.loadRenderTree()
+	if err != nil {
+		return err
+	}
+	if err = p.checkMedia(t.plans); err != nil {
+		return err
 	}
+
+	if prune {
+		p.pruner = newRenderPruner(t)
+	}
+	plan := t.plans[t.root]
+
 	return p.executePlan(plan)
 }
 
-func (p Project) executePlanByName(name string) error {
+func (p Project) loadPlan(name string) (plan Plan, err error) {
 	path := filepath.Join(p.Path, "plan", fmt.Sprintf("%s.json", name))
+	if err = decodeJsonFromFile(path, &plan); err != nil {
+		err = fmt.Errorf("mashu.NewProject: unable to load plan ('%s'): %w", path, err)
+	}
+	return
+}
 
-	var plan Plan
-	if err := decodeJsonFromFile(path, &plan); err != nil {
-		return fmt.Errorf("mashu.NewProject: unable to load plan ('%s'): %w", path, err)
+// ExecutePlan renders the plan name of the project.
+func (p Project) ExecutePlan(name string) error {
+	plan, err := p.loadPlan(name)
+	if err != nil {
+		return err
+	}
+	plans, err := p.reachableFrom(plan)
+	if err != nil {
+		return err
+	}
+	if err = p.checkMedia(plans); err != nil {
+		return err
 	}
 
 	return p.executePlan(plan)
 }
 
+// checkMedia checks, once per source, that the media of the clips among plans
+// left to render still match their fingerprints. Fingerprints refreshed by
+// the check are stored in the catalog when it can be written.
+func (p Project) checkMedia(plans map[string]Plan) (err error) {
+	checked := make(map[string]bool)
+	var touched []Source
+	for name, plan := range plans {
+		if plan.Clip == nil {
+			continue
+		}
+		if _, serr := os.Stat(p.renderPath(name)); serr == nil {
+			continue
+		}
+
+		var s Source
+		if plan.Clip.Source != nil {
+			s = *plan.Clip.Source
+		} else if plan.Clip.SrcKey != nil && !checked[*plan.Clip.SrcKey] {
+			if s, err = p.Catalog.Lookup(*plan.Clip.SrcKey); err != nil {
+				return
+			}
+			checked[s.Key] = true
+		} else {
+			continue
+		}
+
+		var refreshed bool
+		if refreshed, err = s.CheckMedia(); err != nil {
+			return
+		}
+		if refreshed && plan.Clip.Source == nil {
+			touched = append(touched, s)
+		}
+	}
+
+	if len(touched) == 0 {
+		return
+	}
+	if err = catalogBatch(p.Catalog, func(b Catalog) error {
+		for _, s := range touched {
+			if err := b.Update(s); err != nil {
+				return fmt.Errorf("mashu.Project.checkMedia: unable to update '%s': %w", s.Key, err)
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("mashu.Project.checkMedia: keeping the previous fingerprints: %v", err)
+	}
+	return nil
+}
+
+func (p Project) executePlanByName(name string) error {
+	plan, err := p.loadPlan(name)
+	if err != nil {
+		return err
+	}
+
+	return p.executePlan(plan)
+}
+
+func (p Project) renderPath(name string) string {
+	return filepath.Join(p.Path, "render",
+		fmt.Sprintf("%s.%s", name, strings.ToLower(p.Format.Format)))
+}
+
 func (p Project) getInput(name string) (i Input, err error) {
-	i = Input(filepath.Join(p.Path, "render",
-		fmt.Sprintf("%s.%s", name, strings.ToLower(p.Format.Format))))
+	i = Input(p.renderPath(name))
 	err = i.Valid()
 	return
 }
 
 func (p Project) getOutput(name string) (o Output, err error) {
-	o = Output(filepath.Join(p.Path, "render",
-		fmt.Sprintf("%s.%s", name, strings.ToLower(p.Format.Format))))
+	o = Output(p.renderPath(name))
 	err = o.Valid()
 	return
 }
@@ -109,25 +209,27 @@ func (p Project) executePlan(plan Plan) (err error) {
 	var o Output
 	if o, err = p.getOutput(plan.Name); err != nil {
 		if errors.Is(err, fs.ErrExist) {
-			return nil
+			return p.consumed(plan)
 		}
 		return
 	}
 
 	if plan.Clip != nil {
-		return p.executePlanClip(*plan.Clip, o)
-	}
-	if plan.Blend != nil {
-		return p.executePlanBlend(*plan.Blend, o)
-	}
-	if plan.Concat != nil {
-		return p.executePlanConcat(*plan.Concat, o)
+		err = p.executePlanClip(*plan.Clip, o)
+	} else if plan.Blend != nil {
+		err = p.executePlanBlend(*plan.Blend, o)
+	} else if plan.Concat != nil {
+		err = p.executePlanConcat(*plan.Concat, o)
+	} else if plan.Stack != nil {
+		err = p.executePlanStack(*plan.Stack, o)
+	} else {
+		return fmt.Errorf("mashu.Project.executePlan: invalid plan ('%s')", plan.Name)
 	}
-	if plan.Stack != nil {
-		return p.executePlanStack(*plan.Stack, o)
+	if err != nil {
+		return
 	}
 
-	return fmt.Errorf("mashu.Project.executePlan: invalid plan ('%s')", plan.Name)
+	return p.consumed(plan)
 }
 
 func (p Project) executePlanClip(clip PlanClip, output Output) (err error) {
@@ -168,7 +270,7 @@ func (p Project) executePlanConcat(concat PlanConcat, output Output) (err error)
 		}
 	}
 
-	if err = renderConcat(context.TODO(), p.Format, output, inputs); err != nil {
+	if err = renderConcat(context.TODO(), p.Format, output, concat.Duration, inputs); err != nil {
 		return
 	}
 
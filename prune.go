@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// output durations of the known blends
+var blendDurations = map[string]Duration{
+	"demon-slayer-scrolls": Duration{time.Second * 20},
+}
+
+// assumed size in bytes of a second of rendered output, when no existing
+// render of the project can be measured
+const renderRate = 1 << 20
+
+// renderTree holds the plans reachable from a project's root plan and, for
+// each, how many plans consume its render.
+type renderTree struct {
+	root      string
+	plans     map[string]Plan
+	consumers map[string]int
+}
+
+// distinctInputs returns the inputs of plan, each once.
+func distinctInputs(plan Plan) (names []string) {
+	seen := make(map[string]bool)
+	for _, name := range plan.inputs() {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+func (p Project) loadRenderTree() (t renderTree, err error) {
+	var root Plan
+	if root, t.plans, err = p.reachablePlans(); err != nil {
+		return
+	}
+
+	t.root = root.Name
+	t.consumers = make(map[string]int)
+	for _, plan := range t.plans {
+		for _, name := range distinctInputs(plan) {
+			t.consumers[name]++
+		}
+	}
+
+	return
+}
+
+// kept reports whether the render of name must survive pruning.
+func (t renderTree) kept(name string) bool {
+	return name == t.root || t.plans[name].Pinned
+}
+
+// duration returns how long the render of name lasts.
+func (t renderTree) duration(name string) (d Duration) {
+	plan := t.plans[name]
+	switch {
+	case plan.Clip != nil:
+		d = Duration{plan.Clip.Region.Duration()}
+	case plan.Stack != nil:
+		d = plan.Stack.Duration
+	case plan.Blend != nil:
+		d = blendDurations[plan.Blend.Name]
+	case plan.Concat != nil:
+		if plan.Concat.Duration != nil {
+			return *plan.Concat.Duration
+		}
+		for _, input := range plan.Concat.Input {
+			d = d.Add(t.duration(input))
+		}
+	}
+	return
+}
+
+type renderPruner struct {
+	t         renderTree
+	consumers map[string]int
+	done      map[string]bool
+}
+
+func newRenderPruner(t renderTree) *renderPruner {
+	pr := &renderPruner{t: t, consumers: make(map[string]int), done: make(map[string]bool)}
+	for name, n := range t.consumers {
+		pr.consumers[name] = n
+	}
+	return pr
+}
+
+// consumed notes that the render of plan exists. When pruning, the render of
+// each of its inputs is deleted once every plan consuming it has rendered.
+func (p Project) consumed(plan Plan) (err error) {
+	pr := p.pruner
+	if pr == nil || pr.done[plan.Name] {
+		return
+	}
+	pr.done[plan.Name] = true
+
+	for _, name := range distinctInputs(plan) {
+		if pr.consumers[name]--; pr.consumers[name] > 0 || pr.t.kept(name) {
+			continue
+		}
+		if err = os.Remove(p.renderPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		err = nil
+	}
+
+	return
+}
+
+// EstimatePeakDisk estimates the most disk space the project's renders will
+// take while executing it, walking the plans in execution order. Renders
+// that do not exist yet are sized by their duration at the rate measured on
+// existing renders, or at renderRate.
+func (p Project) EstimatePeakDisk(prune bool) (peak int64, err error) {
+	var t renderTree
+	if t, err = p.loadRenderTree(); err != nil {
+		return
+	}
+
+	sizes := make(map[string]int64)
+	var current int64
+	var measured time.Duration
+	for name := range t.plans {
+		if fi, err := os.Stat(p.renderPath(name)); err == nil {
+			sizes[name] = fi.Size()
+			current += fi.Size()
+			measured += t.duration(name).Duration
+		}
+	}
+	peak = current
+
+	rate := float64(renderRate)
+	if measured > 0 {
+		rate = float64(current) / measured.Seconds()
+	}
+
+	consumers := t.consumers
+	done := make(map[string]bool)
+	var walk func(name string)
+	walk = func(name string) {
+		if done[name] {
+			return
+		}
+		done[name] = true
+
+		if _, ok := sizes[name]; !ok {
+			for _, input := range t.plans[name].inputs() {
+				walk(input)
+			}
+			sizes[name] = int64(t.duration(name).Seconds() * rate)
+			if current += sizes[name]; current > peak {
+				peak = current
+			}
+		}
+
+		if !prune {
+			return
+		}
+		for _, input := range distinctInputs(t.plans[name]) {
+			if consumers[input]--; consumers[input] == 0 && !t.kept(input) {
+				current -= sizes[input]
+			}
+		}
+	}
+	walk(t.root)
+
+	return
+}
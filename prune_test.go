@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	generator := `{"Target":"30s","Alignment":"1s","MaxConcat":2,"Segments":[{"Clip":{"Start":"2s","End":"4s"},"Tickets":1},
+		{"Stack":{"Count":2,"Duration":{"Start":"2s","End":"2s"}},"Tickets":1}]}`
+	p := testProject(t, generator, 4, time.Minute)
+
+	gen, err := p.Generate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gen.Commit(false); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(p.Path, "render"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var tree renderTree
+	if tree, err = p.loadRenderTree(); err != nil {
+		t.Fatal(err)
+	}
+	var pinned string
+	for name, plan := range tree.plans {
+		if plan.Clip != nil {
+			pinned = name
+			plan.Pinned = true
+			tree.plans[name] = plan
+			break
+		}
+	}
+	p.pruner = newRenderPruner(tree)
+
+	// render the tree inputs first, as executing it would
+	var render func(name string)
+	render = func(name string) {
+		if p.pruner.done[name] {
+			return
+		}
+		for _, input := range tree.plans[name].inputs() {
+			render(input)
+		}
+		if err := os.WriteFile(p.renderPath(name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.consumed(tree.plans[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	render(tree.root)
+
+	for name := range tree.plans {
+		_, err := os.Stat(p.renderPath(name))
+		if kept := name == tree.root || name == pinned; kept != (err == nil) {
+			t.Errorf("render of %s kept %v (root %v, pinned %v)", name, err == nil, name == tree.root, name == pinned)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// audio is decoded to mono pcm at a low sample rate and fingerprinted per
+// overlapping frame; each fingerprint holds one bit per adjacent band pair,
+// set when the energy difference between the bands grew since the previous
+// frame
+const (
+	recurringSampleRate = 8000
+	recurringFrame      = 1024
+	recurringHop        = 256
+	recurringBands      = 33
+	recurringMaxBits    = 8 // bits that may differ for frames to match
+	recurringMaxGap     = 3 // consecutive mismatched frames tolerated in a run
+)
+
+var recurringHopDuration = time.Duration(recurringHop) * time.Second / recurringSampleRate
+
+type audioPrint []uint32
+
+// decodeAudio returns the mono samples of the source's audio from start for d.
+func decodeAudio(ctx context.Context, s Source, start, d Duration) (samples []int16, err error) {
+	if s.Audio == nil {
+		return nil, fmt.Errorf("mashu.decodeAudio: source '%s' has no audio", s.Key)
+	}
+
+	var buffer bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-loglevel", loglevel,
+		"-ss", fmt.Sprintf("%dus", start.Microseconds()),
+		"-t", fmt.Sprintf("%dus", d.Microseconds()),
+		"-i", string(s.Audio.Path),
+		"-map", fmt.Sprintf("0:a:%d", s.Audio.Track),
+		"-ac", "1", "-ar", fmt.Sprintf("%d", recurringSampleRate),
+		"-f", "s16le", "-")
+	cmd.Stdout = &buffer
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("mashu.decodeAudio: unable to decode '%s': %w", s.Key, err)
+	}
+
+	samples = make([]int16, buffer.Len()/2)
+	err = binary.Read(&buffer, binary.LittleEndian, samples)
+	return
+}
+
+// fft transforms x in place; len(x) must be a power of two.
+func fft(x []complex128) {
+	n := len(x)
+	for i, j := 1, 0; i < n; i++ {
+		bit := n >> 1
+		for ; j&bit != 0; bit >>= 1 {
+			j ^= bit
+		}
+		j ^= bit
+		if i < j {
+			x[i], x[j] = x[j], x[i]
+		}
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], w*x[start+k+size/2]
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+func bandEnergies(frame []int16) (e [recurringBands]float64) {
+	x := make([]complex128, len(frame))
+	for i, v := range frame {
+		hann := 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(len(frame)-1))
+		x[i] = complex(float64(v)*hann, 0)
+	}
+	fft(x)
+
+	// bands are spaced logarithmically between 300Hz and 2kHz
+	edge := func(b int) int {
+		freq := 300 * math.Pow(2000.0/300, float64(b)/float64(recurringBands))
+		return int(freq * float64(len(frame)) / recurringSampleRate)
+	}
+	for b := range e {
+		lo, hi := edge(b), edge(b+1)
+		if hi <= lo {
+			hi = lo + 1
+		}
+		for k := lo; k < hi; k++ {
+			e[b] += real(x[k])*real(x[k]) + imag(x[k])*imag(x[k])
+		}
+	}
+	return
+}
+
+func fingerprintAudio(samples []int16) (p audioPrint) {
+	var prev [recurringBands]float64
+	for i := 0; i+recurringFrame <= len(samples); i += recurringHop {
+		e := bandEnergies(samples[i : i+recurringFrame])
+		if i > 0 {
+			var f uint32
+			for b := 0; b < recurringBands-1; b++ {
+				if (e[b]-e[b+1])-(prev[b]-prev[b+1]) > 0 {
+					f |= 1 << b
+				}
+			}
+			p = append(p, f)
+		}
+		prev = e
+	}
+	return
+}
+
+type audioMatch struct {
+	A, B   int // first matching frame in each print
+	Frames int
+}
+
+// longestMatch finds the longest run of matching frames shared by two prints
+// at any relative offset.
+func longestMatch(a, b audioPrint) (best audioMatch) {
+	for offset := -len(a) + 1; offset < len(b); offset++ {
+		run, gap, start := 0, 0, 0
+		for i := 0; i < len(a); i++ {
+			j := i + offset
+			if j < 0 || j >= len(b) {
+				continue
+			}
+			if bits.OnesCount32(a[i]^b[j]) <= recurringMaxBits {
+				if run == 0 {
+					start = i
+				}
+				run += gap + 1
+				gap = 0
+				if run > best.Frames {
+					best = audioMatch{start, start + offset, run}
+				}
+			} else if run > 0 {
+				gap++
+				if gap > recurringMaxGap {
+					run, gap = 0, 0
+				}
+			}
+		}
+	}
+	return
+}
+
+func framesDuration(frames int) Duration {
+	return Duration{time.Duration(frames) * recurringHopDuration}
+}
+
+// recurringKeys resolves arguments to catalog keys: m3u files contribute their
+// entries and anything else is treated as a key prefix.
+func recurringKeys(c Catalog, args []string) (keys []string, err error) {
+	var all []string
+	if all, err = c.Keys(context.TODO()); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	add := func(key string) {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, arg := range args {
+		var entries []string
+		if entries, err = getM3uEntries(arg); err == nil {
+			for _, e := range entries {
+				add(e)
+			}
+			continue
+		}
+		err = nil
+
+		for _, key := range all {
+			if strings.HasPrefix(key, arg) {
+				add(key)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	return
+}
+
+type recurringPart struct {
+	Tag   string
+	Start Duration
+	Print audioPrint
+}
+
+func hasTaggedRegion(s Source, r Region, tag string) bool {
+	for _, e := range s.Regions {
+		if e.Region != r {
+			continue
+		}
+		for _, t := range e.Tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TagRecurring compares the audio at the start and end of every source with
+// that of its neighbours (in key order) and tags the longest shared segments
+// of at least minimum as intro and outro.
+func TagRecurring(ctx context.Context, c Catalog, keys []string, window, minimum Duration) (err error) {
+	if len(keys) < 2 {
+		return fmt.Errorf("mashu.TagRecurring: need at least two sources (got %d)", len(keys))
+	}
+
+	sources := make([]Source, len(keys))
+	parts := make([][2]recurringPart, len(keys))
+	for i, key := range keys {
+		if sources[i], err = c.Lookup(key); err != nil {
+			return
+		}
+		s := sources[i]
+		if s.Audio == nil {
+			return fmt.Errorf("mashu.TagRecurring: source '%s' has no audio", key)
+		}
+
+		var r probeResult
+		if r, err = ffprobe(string(s.Audio.Path)); err != nil {
+			return
+		}
+		var end Duration
+		if end, err = r.Duration(); err != nil {
+			return
+		}
+
+		outroStart := Duration{end.Duration - window.Duration}
+		if outroStart.Duration < 0 {
+			outroStart.Duration = 0
+		}
+		for p, part := range []recurringPart{{"intro", Duration{}, nil}, {"outro", outroStart, nil}} {
+			var samples []int16
+			if samples, err = decodeAudio(ctx, s, part.Start, window); err != nil {
+				return
+			}
+			part.Print = fingerprintAudio(samples)
+			parts[i][p] = part
+		}
+	}
+
+	updated := make([]bool, len(keys))
+	for i := range sources {
+		for p := range parts[i] {
+			var best audioMatch
+			for _, j := range []int{(i + len(keys) - 1) % len(keys), (i + 1) % len(keys)} {
+				if j == i {
+					continue
+				}
+				if m := longestMatch(parts[i][p].Print, parts[j][p].Print); m.Frames > best.Frames {
+					best = m
+				}
+			}
+
+			if framesDuration(best.Frames).Duration < minimum.Duration {
+				continue
+			}
+
+			// prints start with the second frame of the decoded audio
+			part := parts[i][p]
+			r := Region{
+				Start: part.Start.Add(framesDuration(best.A + 1)),
+				End:   part.Start.Add(framesDuration(best.A + 1 + best.Frames)),
+			}
+			if hasTaggedRegion(sources[i], r, part.Tag) {
+				continue
+			}
+			sources[i].Regions = append(sources[i].Regions, TaggedRegion{Region: r, Tags: []string{part.Tag}})
+			updated[i] = true
+		}
+	}
+
+	return catalogBatch(c, func(b Catalog) error {
+		for i, s := range sources {
+			if !updated[i] {
+				continue
+			}
+			if err := b.Update(s); err != nil {
+				return fmt.Errorf("mashu.TagRecurring: unable to update '%s': %w", s.Key, err)
+			}
+		}
+		return nil
+	})
+}
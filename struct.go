@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -31,9 +32,11 @@ func (i Input) Valid() error {
 
 // TODO add an offset feature (for situations like unsynced a/v/s tracks)
 type Track struct {
-	Path   Input
-	Track  uint
-	Filter *string `json:",omitempty"`
+	Path     Input
+	Track    uint
+	Filter   *string `json:",omitempty"`
+	Language string  `json:",omitempty"`
+	Title    string  `json:",omitempty"`
 }
 
 func (t Track) Valid() error {
@@ -82,15 +85,59 @@ func (r Region) Duration() time.Duration {
 	return r.End.Duration - r.Start.Duration
 }
 
-func (r Region) RandomTruncated(alignment Duration) Duration {
+func (r Region) RandomTruncated(rnd *rand.Rand, alignment Duration) Duration {
 	diff := r.Duration()
 	if diff == 0 {
 		return Duration{r.Start.Truncate(alignment.Duration)}
 	}
-	random := time.Duration(rand.Int63n(int64(diff)))
+	random := time.Duration(rnd.Int63n(int64(diff)))
 	return Duration{(r.Start.Duration + random).Truncate(alignment.Duration)}
 }
 
+// Subtract returns the parts of r not covered by any of exclusions, in order.
+func (r Region) Subtract(exclusions []Region) (parts []Region) {
+	sorted := append([]Region(nil), exclusions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Duration < sorted[j].Start.Duration })
+
+	start := r.Start
+	for _, e := range sorted {
+		if e.End.Duration <= start.Duration || e.Start.Duration >= r.End.Duration {
+			continue
+		}
+		if e.Start.Duration > start.Duration {
+			parts = append(parts, Region{start, e.Start})
+		}
+		if e.End.Duration > start.Duration {
+			start = e.End
+		}
+	}
+	if start.Duration < r.End.Duration {
+		parts = append(parts, Region{start, r.End})
+	}
+
+	return
+}
+
+// coveredDuration returns the length of the union of regions, counting
+// overlapping footage once.
+func coveredDuration(regions []TaggedRegion) (d time.Duration) {
+	sorted := append([]TaggedRegion(nil), regions...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Duration < sorted[j].Start.Duration })
+
+	var end time.Duration
+	for _, r := range sorted {
+		start := r.Start.Duration
+		if start < end {
+			start = end
+		}
+		if r.End.Duration > start {
+			d += r.End.Duration - start
+			end = r.End.Duration
+		}
+	}
+	return
+}
+
 func (r Region) Valid() error {
 	if r.Start == r.End || r.Start.Duration > r.End.Duration {
 		return fmt.Errorf("mashu.Region.Valid: start and end must be different and end must be after start (not %v to %v)", r.Start, r.End)
@@ -102,6 +149,20 @@ func (r Region) Valid() error {
 type TaggedRegion struct {
 	Region
 	Tags []string `json:",omitempty"`
+	// relative likelihood of being picked when sampling by weight; zero is
+	// treated as one
+	Weight float64 `json:",omitempty"`
+}
+
+func sampleWeight(w float64) float64 {
+	if w == 0 {
+		return 1
+	}
+	return w
+}
+
+func (r TaggedRegion) weight() float64 {
+	return sampleWeight(r.Weight)
 }
 
 func (r TaggedRegion) Duration() time.Duration {
@@ -109,6 +170,9 @@ func (r TaggedRegion) Duration() time.Duration {
 }
 
 func (r TaggedRegion) Valid() error {
+	if r.Weight < 0 {
+		return fmt.Errorf("mashu.TaggedRegion.Valid: weight must not be negative (not %v)", r.Weight)
+	}
 	return r.Region.Valid()
 }
 
@@ -134,8 +198,48 @@ type Source struct {
 	Video    *Track `json:",omitempty"`
 	Audio    *Track `json:",omitempty"`
 	Subtitle *Track `json:",omitempty"`
-	Regions  []TaggedRegion
-	Stamp    *Stamp `json:",omitempty"`
+	// other tracks that may replace Audio or Subtitle to match the
+	// languages preferred by a format
+	AudioAlternatives    []Track `json:",omitempty"`
+	SubtitleAlternatives []Track `json:",omitempty"`
+	Regions              []TaggedRegion
+	Stamp                *Stamp                `json:",omitempty"`
+	Media                map[Input]Fingerprint `json:",omitempty"`
+	// set on batch cataloged sources until they are reviewed interactively
+	Unreviewed bool `json:",omitempty"`
+	// relative likelihood of being picked when sampling by weight; zero is
+	// treated as one
+	Weight float64 `json:",omitempty"`
+	// free-form fields such as series, season or episode, used to order
+	// sources
+	Metadata map[string]string `json:",omitempty"`
+}
+
+// selectTrack returns the first of current and alternatives in one of
+// languages; with subtitles, "none" selects no track.
+func selectTrack(languages []string, current *Track, alternatives []Track, subtitles bool) *Track {
+	for _, l := range languages {
+		if l == "none" && subtitles {
+			return nil
+		}
+		if current != nil && current.Language == l {
+			return current
+		}
+		for i := range alternatives {
+			if alternatives[i].Language == l {
+				return &alternatives[i]
+			}
+		}
+	}
+	return current
+}
+
+// WithLanguages returns the source with its audio and subtitle tracks
+// replaced by the first tracks matching the format's preferred languages.
+func (s Source) WithLanguages(f Format) Source {
+	s.Audio = selectTrack(f.AudioLanguages, s.Audio, s.AudioAlternatives, false)
+	s.Subtitle = selectTrack(f.SubtitleLanguages, s.Subtitle, s.SubtitleAlternatives, true)
+	return s
 }
 
 func (s Source) Valid() error {
@@ -154,6 +258,16 @@ func (s Source) Valid() error {
 			return fmt.Errorf("mashu.Source.Valid: invalid subtitle specified: %w", err)
 		}
 	}
+	for _, t := range s.AudioAlternatives {
+		if err := t.Valid(); err != nil {
+			return fmt.Errorf("mashu.Source.Valid: invalid alternative audio specified: %w", err)
+		}
+	}
+	for _, t := range s.SubtitleAlternatives {
+		if err := t.Valid(); err != nil {
+			return fmt.Errorf("mashu.Source.Valid: invalid alternative subtitle specified: %w", err)
+		}
+	}
 	for _, r := range s.Regions {
 		if err := r.Valid(); err != nil {
 			return fmt.Errorf("mashu.Source.Valid: bad region: %w", err)
@@ -164,6 +278,9 @@ func (s Source) Valid() error {
 			return fmt.Errorf("mashu.Source.Valid: invalid stamp: %w", err)
 		}
 	}
+	if s.Weight < 0 {
+		return fmt.Errorf("mashu.Source.Valid: weight must not be negative (not %v)", s.Weight)
+	}
 
 	return nil
 }
@@ -182,6 +299,10 @@ type Format struct {
 	Width      uint
 	Height     uint
 	Stamp      Stamp
+	// preferred track languages, most preferred first; a subtitle language
+	// of "none" prefers no subtitles over the remaining languages
+	AudioLanguages    []string `json:",omitempty"`
+	SubtitleLanguages []string `json:",omitempty"`
 }
 
 func (f Format) Valid() error {
@@ -197,6 +318,11 @@ func (f Format) Valid() error {
 	if err := f.Stamp.Valid(); err != nil {
 		return fmt.Errorf("mashu.Format.Valid: invalid stamp: %w", err)
 	}
+	for _, l := range f.AudioLanguages {
+		if l == "none" {
+			return fmt.Errorf("mashu.Format.Valid: audio languages must not include 'none' (clips need audio)")
+		}
+	}
 	if f.FrameRate == 0 {
 		return fmt.Errorf("mashu.Format.Valid: framerate must be non-zero")
 	}
@@ -272,7 +398,7 @@ type Attachments map[string]Input
 func (a Attachments) Valid() error {
 	for _, v := range a {
 		if err := v.Valid(); err != nil {
-			return fmt.Errorf("mashu.Attachments.Valid: invalid attachment: %w", v, err)
+			return fmt.Errorf("mashu.Attachments.Valid: invalid attachment (%s): %w", v, err)
 		}
 	}
 
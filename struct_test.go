@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func seconds(n int) Duration {
+	return Duration{time.Duration(n) * time.Second}
+}
+
+func span(start, end int) Region {
+	return Region{seconds(start), seconds(end)}
+}
+
+func TestRegionSubtract(t *testing.T) {
+	tests := []struct {
+		r          Region
+		exclusions []Region
+		parts      []Region
+	}{
+		{span(0, 100), nil, []Region{span(0, 100)}},
+		{span(0, 100), []Region{span(20, 30)}, []Region{span(0, 20), span(30, 100)}},
+		{span(0, 100), []Region{span(60, 70), span(20, 30)}, []Region{span(0, 20), span(30, 60), span(70, 100)}},
+		{span(0, 100), []Region{span(0, 10), span(90, 100)}, []Region{span(10, 90)}},
+		{span(0, 100), []Region{span(20, 50), span(40, 60)}, []Region{span(0, 20), span(60, 100)}},
+		{span(0, 100), []Region{span(20, 60), span(30, 40)}, []Region{span(0, 20), span(60, 100)}},
+		{span(10, 20), []Region{span(0, 5), span(30, 40)}, []Region{span(10, 20)}},
+		{span(10, 20), []Region{span(0, 30)}, nil},
+	}
+
+	for _, test := range tests {
+		if parts := test.r.Subtract(test.exclusions); !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("%v.Subtract(%v) = %v, want %v", test.r, test.exclusions, parts, test.parts)
+		}
+	}
+}
+
+func TestCoveredDuration(t *testing.T) {
+	tests := []struct {
+		regions []Region
+		covered Duration
+	}{
+		{nil, seconds(0)},
+		{[]Region{span(0, 100)}, seconds(100)},
+		{[]Region{span(0, 100), span(20, 30)}, seconds(100)},
+		{[]Region{span(50, 70), span(0, 60)}, seconds(70)},
+		{[]Region{span(0, 10), span(20, 30)}, seconds(20)},
+		{[]Region{span(0, 10), span(10, 20), span(5, 15)}, seconds(20)},
+	}
+
+	for _, test := range tests {
+		var regions []TaggedRegion
+		for _, r := range test.regions {
+			regions = append(regions, TaggedRegion{Region: r})
+		}
+		if covered := coveredDuration(regions); covered != test.covered.Duration {
+			t.Errorf("coveredDuration(%v) = %v, want %v", test.regions, covered, test.covered)
+		}
+	}
+}
+
+func TestSelectTrack(t *testing.T) {
+	en := Track{Path: "en.mkv", Language: "en"}
+	ja := Track{Path: "ja.mkv", Language: "ja"}
+
+	s := Source{Audio: &en, AudioAlternatives: []Track{ja}, Subtitle: &en, SubtitleAlternatives: []Track{ja}}
+	s = s.WithLanguages(Format{AudioLanguages: []string{"ja"}, SubtitleLanguages: []string{"none", "en"}})
+	if s.Audio == nil || s.Audio.Language != "ja" {
+		t.Errorf("audio = %v, want ja", s.Audio)
+	}
+	if s.Subtitle != nil {
+		t.Errorf("subtitle = %v, want none", s.Subtitle)
+	}
+
+	if err := (Format{AudioLanguages: []string{"none"}}).Valid(); err == nil {
+		t.Error("format with no audio language valid, want an error")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// TagExpr is a boolean expression over tags, such as
+//
+//	(fight OR chase) AND NOT spoiler
+//
+// AND, OR and NOT (or &, | and !) combine terms, parentheses group them, and
+// juxtaposed terms are ANDed. Operators must be written in capitals; other
+// spellings, such as "or", are rejected rather than read as tags. A term
+// matches a tag as described by
+// tagMatches; terms containing * or ? are glob patterns matched against a tag
+// or any of its ancestors.
+type TagExpr struct {
+	source string
+	root   *tagNode
+}
+
+type tagNode struct {
+	op       string // tag, not, and, or
+	tag      string
+	children []*tagNode
+}
+
+func (n *tagNode) match(tags []string) bool {
+	switch n.op {
+	case "tag":
+		return matchTerm(n.tag, tags)
+	case "not":
+		return !n.children[0].match(tags)
+	case "and":
+		for _, c := range n.children {
+			if !c.match(tags) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, c := range n.children {
+			if c.match(tags) {
+				return true
+			}
+		}
+		return false
+	}
+	panic(fmt.Sprintf("mashu.tagNode.match: unknown op '%s'", n.op))
+}
+
+func matchTerm(term string, tags []string) bool {
+	if !strings.ContainsAny(term, "*?[") {
+		return hasTag(tags, term)
+	}
+
+	for _, tag := range tags {
+		for t := tag; ; {
+			if ok, _ := path.Match(term, t); ok {
+				return true
+			}
+			i := strings.LastIndexByte(t, '/')
+			if i < 0 {
+				break
+			}
+			t = t[:i]
+		}
+	}
+	return false
+}
+
+func tokenizeTagExpr(s string) (tokens []string) {
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens = append(tokens, word.String())
+			word.Reset()
+		}
+	}
+
+	for _, r := range s {
+		switch {
+		case unicode.IsSpace(r):
+			flush()
+		case strings.ContainsRune("()!&|", r):
+			flush()
+			tokens = append(tokens, string(r))
+		default:
+			word.WriteRune(r)
+		}
+	}
+	flush()
+
+	return
+}
+
+type tagExprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *tagExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *tagExprParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *tagExprParser) or() (n *tagNode, err error) {
+	if n, err = p.and(); err != nil {
+		return
+	}
+	for p.peek() == "OR" || p.peek() == "|" {
+		p.next()
+		var c *tagNode
+		if c, err = p.and(); err != nil {
+			return
+		}
+		n = &tagNode{op: "or", children: []*tagNode{n, c}}
+	}
+	return
+}
+
+func (p *tagExprParser) and() (n *tagNode, err error) {
+	if n, err = p.unary(); err != nil {
+		return
+	}
+	for {
+		switch p.peek() {
+		case "AND", "&":
+			p.next()
+		case "", ")", "OR", "|":
+			return
+		}
+		var c *tagNode
+		if c, err = p.unary(); err != nil {
+			return
+		}
+		n = &tagNode{op: "and", children: []*tagNode{n, c}}
+	}
+}
+
+func (p *tagExprParser) unary() (n *tagNode, err error) {
+	switch t := p.next(); t {
+	case "NOT", "!":
+		var c *tagNode
+		if c, err = p.unary(); err != nil {
+			return
+		}
+		return &tagNode{op: "not", children: []*tagNode{c}}, nil
+	case "(":
+		if n, err = p.or(); err != nil {
+			return
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case ")", "AND", "&", "OR", "|":
+		return nil, fmt.Errorf("unexpected '%s'", t)
+	default:
+		if u := strings.ToUpper(t); u == "AND" || u == "OR" || u == "NOT" {
+			return nil, fmt.Errorf("'%s' is not an operator; write %s", t, u)
+		}
+		if _, err = path.Match(t, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern '%s': %w", t, err)
+		}
+		return &tagNode{op: "tag", tag: t}, nil
+	}
+}
+
+func ParseTagExpr(s string) (e *TagExpr, err error) {
+	e = &TagExpr{source: s}
+
+	p := tagExprParser{tokens: tokenizeTagExpr(s)}
+	if len(p.tokens) == 0 {
+		return
+	}
+	if e.root, err = p.or(); err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected '%s'", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("mashu.ParseTagExpr: invalid tag expression '%s': %w", s, err)
+	}
+
+	return
+}
+
+// Match reports whether tags satisfy the expression; an empty expression
+// matches anything.
+func (e *TagExpr) Match(tags []string) bool {
+	return e == nil || e.root == nil || e.root.match(tags)
+}
+
+// excludes reports whether tags match a negated term of the expression's
+// top-level conjunction, as spoiler does in "fight AND NOT spoiler".
+func (e *TagExpr) excludes(tags []string) bool {
+	if e == nil || e.root == nil {
+		return false
+	}
+
+	pending := []*tagNode{e.root}
+	for len(pending) > 0 {
+		n := pending[0]
+		pending = pending[1:]
+		switch n.op {
+		case "and":
+			pending = append(pending, n.children...)
+		case "not":
+			if n.children[0].match(tags) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *TagExpr) String() string {
+	return e.source
+}
+
+func (e *TagExpr) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+
+	var parsed *TagExpr
+	if parsed, err = ParseTagExpr(s); err != nil {
+		return
+	}
+	*e = *parsed
+	return
+}
+
+func (e TagExpr) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.source)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestParseTagExpr(t *testing.T) {
+	tests := []struct {
+		expr    string
+		tags    []string
+		matches bool
+	}{
+		{"", nil, true},
+		{"fight", []string{"fight"}, true},
+		{"fight", []string{"chase"}, false},
+		{"char", []string{"char/tanjiro"}, true},
+		{"char", []string{"character"}, false},
+		{"fight chase", []string{"fight"}, false},
+		{"fight AND chase", []string{"chase", "fight"}, true},
+		{"fight & chase", []string{"chase", "fight"}, true},
+		{"fight OR chase", []string{"chase"}, true},
+		{"fight | chase", []string{"night"}, false},
+		{"(fight OR chase) AND NOT spoiler", []string{"fight"}, true},
+		{"(fight OR chase) AND NOT spoiler", []string{"fight", "spoiler"}, false},
+		{"!spoiler", nil, true},
+		{"NOT NOT spoiler", []string{"spoiler"}, true},
+		{"fight OR chase AND night", []string{"fight"}, true},
+		{"char/*", []string{"char/tanjiro/young"}, true},
+		{"ch?r", []string{"char/tanjiro"}, true},
+		{"op*", []string{"ed"}, false},
+	}
+
+	for _, test := range tests {
+		e, err := ParseTagExpr(test.expr)
+		if err != nil {
+			t.Errorf("ParseTagExpr(%q): %v", test.expr, err)
+			continue
+		}
+		if got := e.Match(test.tags); got != test.matches {
+			t.Errorf("ParseTagExpr(%q).Match(%q) = %v, want %v", test.expr, test.tags, got, test.matches)
+		}
+	}
+}
+
+func TestParseTagExprErrors(t *testing.T) {
+	for _, expr := range []string{"(", "fight)", "fight AND", "OR chase", "NOT", "fight ()", "[a", "fight or chase", "fight and not spoiler", "Not spoiler"} {
+		if _, err := ParseTagExpr(expr); err == nil {
+			t.Errorf("ParseTagExpr(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestTagExprExcludes(t *testing.T) {
+	tests := []struct {
+		expr     string
+		tags     []string
+		excludes bool
+	}{
+		{"fight AND NOT spoiler", []string{"spoiler"}, true},
+		{"fight AND NOT spoiler", []string{"fight"}, false},
+		{"fight OR NOT spoiler", []string{"spoiler"}, false},
+		{"NOT (fight OR spoiler)", []string{"fight"}, true},
+	}
+
+	for _, test := range tests {
+		e, err := ParseTagExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := e.excludes(test.tags); got != test.excludes {
+			t.Errorf("ParseTagExpr(%q).excludes(%q) = %v, want %v", test.expr, test.tags, got, test.excludes)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Tags are hierarchical, with levels separated by '/'. A tag matches a filter
+// when it equals the filter or descends from it, so "char" matches
+// "char/tanjiro" but not "character".
+func tagMatches(filter, tag string) bool {
+	return tag == filter || strings.HasPrefix(tag, filter+"/")
+}
+
+func hasTag(tags []string, filter string) bool {
+	for _, tag := range tags {
+		if tagMatches(filter, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteTags replaces every tag in the catalog with the result of fn,
+// dropping tags for which it returns false, and returns the number of sources
+// updated.
+func RewriteTags(ctx context.Context, c Catalog, fn func(tag string) (string, bool)) (n int, err error) {
+	err = catalogBatch(c, func(b Catalog) (err error) {
+		var keys []string
+		if keys, err = b.Keys(ctx); err != nil {
+			return
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			var s Source
+			if s, err = b.Lookup(key); err != nil {
+				return
+			}
+
+			changed := false
+			for i, r := range s.Regions {
+				var tags []string
+				seen := make(map[string]bool)
+				for _, tag := range r.Tags {
+					t, keep := fn(tag)
+					if !keep || seen[t] {
+						changed = true
+						continue
+					}
+					if t != tag {
+						changed = true
+					}
+					seen[t] = true
+					tags = append(tags, t)
+				}
+				s.Regions[i].Tags = tags
+			}
+
+			if !changed {
+				continue
+			}
+			if err = b.Update(s); err != nil {
+				err = fmt.Errorf("mashu.RewriteTags: unable to update '%s': %w", key, err)
+				return
+			}
+			n++
+		}
+
+		return
+	})
+	return
+}
+
+// renameTag moves tag, and its descendants, from under one tag to another.
+func renameTag(tag, from, to string) string {
+	if !tagMatches(from, tag) {
+		return tag
+	}
+	return to + strings.TrimPrefix(tag, from)
+}
+
+// RenameTags renames each of from (and its descendants) to to; renaming
+// several tags to the same name merges them.
+func RenameTags(ctx context.Context, c Catalog, to string, from ...string) (int, error) {
+	return RewriteTags(ctx, c, func(tag string) (string, bool) {
+		for _, f := range from {
+			tag = renameTag(tag, f, to)
+		}
+		return tag, true
+	})
+}
+
+// DeleteTags removes each of tags, and their descendants, from every region.
+func DeleteTags(ctx context.Context, c Catalog, tags ...string) (int, error) {
+	return RewriteTags(ctx, c, func(tag string) (string, bool) {
+		for _, t := range tags {
+			if tagMatches(t, tag) {
+				return tag, false
+			}
+		}
+		return tag, true
+	})
+}